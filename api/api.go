@@ -2,9 +2,14 @@ package api
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"net/http"
+	"serra/config"
+	"serra/mailer"
+	"serra/service/message"
 	"serra/service/user"
+	"serra/utils"
 
 	"github.com/gorilla/mux"
 )
@@ -25,9 +30,59 @@ func (s *ApiServer) Run() error {
 	router := mux.NewRouter()
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
+	mail, err := mailer.New(config.Envs)
+	if err != nil {
+		return err
+	}
+
+	keys, err := utils.LoadKeySet(config.Envs.JWTSigningKey, config.Envs.JWTVerificationKeys)
+	if err != nil {
+		return err
+	}
+	if config.Envs.JWTSigningKey == "" {
+		log.Println("JWT_SIGNING_KEY is not set, tokens are signed with a temporary key")
+	}
+	utils.SetKeySet(keys)
+
+	// Other services verify our tokens with these keys.
+	router.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(keys.JWKS())
+	}).Methods("GET")
+
+	otp, err := utils.NewOTPService(config.Envs.OTPLength, config.Envs.OTPAlphabet, config.Envs.OTPTTL)
+	if err != nil {
+		return err
+	}
+
+	var breached *utils.BreachedPasswords
+	if config.Envs.BreachedPasswordsDir != "" {
+		breached, err = utils.NewBreachedPasswords(config.Envs.BreachedPasswordsDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	passwords, err := utils.NewPasswordPolicy(config.Envs.PasswordMinLength, config.Envs.PasswordMaxLength, config.Envs.PasswordMinScore, breached)
+	if err != nil {
+		return err
+	}
+
+	messageStore := message.NewStore(s.db)
+	hub := message.NewHub(messageStore)
+
 	userStore := user.NewStore(s.db)
-	userHandler := user.NewHandler(userStore)
+	utils.SetSessionCache(utils.NewSessionCache(userStore.LookupSession, config.Envs.SessionCacheTTL))
+	utils.SetSessionListener(hub)
+
+	userHandler := user.NewHandler(userStore, hub, mail, otp, passwords)
 	userHandler.RegisterRoutes(subrouter)
+	user.StartCleanup(userStore, hub, config.Envs.CleanupInterval, config.Envs.UnverifiedAccountMaxAge)
+
+	messageHandler := message.NewHandler(messageStore, hub)
+	messageHandler.RegisterRoutes(subrouter)
+
 	log.Println("Listening on:", s.addr)
-	return http.ListenAndServe(s.addr, subrouter)
+	return http.ListenAndServe(s.addr, router)
 }
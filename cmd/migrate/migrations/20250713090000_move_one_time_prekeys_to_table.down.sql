@@ -0,0 +1,11 @@
+ALTER TABLE prekeys ADD COLUMN one_time_prekeys JSON NULL;
+
+UPDATE prekeys p
+SET p.one_time_prekeys = COALESCE(
+    (SELECT JSON_ARRAYAGG(k.prekey) FROM one_time_prekeys k WHERE k.user_id = p.user_id),
+    JSON_ARRAY()
+);
+
+ALTER TABLE prekeys MODIFY COLUMN one_time_prekeys JSON NOT NULL;
+
+DROP TABLE IF EXISTS one_time_prekeys;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS one_time_prekeys (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    prekey TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_one_time_prekeys_user (user_id, id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+INSERT INTO one_time_prekeys (user_id, prekey)
+SELECT p.user_id, k.prekey
+FROM prekeys p,
+JSON_TABLE(p.one_time_prekeys, '$[*]' COLUMNS (prekey TEXT PATH '$')) AS k;
+
+ALTER TABLE prekeys DROP COLUMN one_time_prekeys;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS signed_prekey_history;
+
+ALTER TABLE one_time_prekeys DROP INDEX uq_one_time_prekeys_key;
+ALTER TABLE one_time_prekeys DROP COLUMN key_id;
+
+ALTER TABLE prekeys DROP COLUMN signed_prekey_id;
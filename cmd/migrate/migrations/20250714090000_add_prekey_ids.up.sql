@@ -0,0 +1,18 @@
+ALTER TABLE prekeys ADD COLUMN signed_prekey_id INT UNSIGNED NOT NULL DEFAULT 0 AFTER identity_key;
+
+-- Clients can't tell which private key belongs to a one-time prekey uploaded
+-- without an ID, so those are dropped and clients upload new ones.
+DELETE FROM one_time_prekeys;
+ALTER TABLE one_time_prekeys ADD COLUMN key_id INT UNSIGNED NOT NULL DEFAULT 0 AFTER user_id;
+ALTER TABLE one_time_prekeys ADD UNIQUE KEY uq_one_time_prekeys_key (user_id, key_id);
+
+CREATE TABLE IF NOT EXISTS signed_prekey_history (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    key_id INT UNSIGNED NOT NULL,
+    signed_prekey TEXT NOT NULL,
+    signed_prekey_signature TEXT NOT NULL,
+    replaced_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_signed_prekey_history_user (user_id, replaced_at),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,27 @@
+ALTER TABLE messages DROP COLUMN sender_device_id;
+
+ALTER TABLE refresh_tokens DROP FOREIGN KEY fk_refresh_tokens_device;
+ALTER TABLE refresh_tokens DROP COLUMN device_id;
+
+ALTER TABLE signed_prekey_history DROP FOREIGN KEY fk_signed_prekey_history_device;
+ALTER TABLE signed_prekey_history DROP INDEX idx_signed_prekey_history_device, DROP COLUMN device_id;
+
+-- Only one device per user can survive the way back.
+DELETE k FROM one_time_prekeys k
+JOIN (SELECT user_id, MIN(device_id) AS device_id FROM prekeys GROUP BY user_id) keep ON keep.user_id = k.user_id
+WHERE k.device_id != keep.device_id;
+ALTER TABLE one_time_prekeys DROP FOREIGN KEY fk_one_time_prekeys_device;
+ALTER TABLE one_time_prekeys
+    DROP INDEX uq_one_time_prekeys_key,
+    DROP INDEX idx_one_time_prekeys_device,
+    DROP COLUMN device_id,
+    ADD UNIQUE KEY uq_one_time_prekeys_key (user_id, key_id);
+
+DELETE p FROM prekeys p
+JOIN (SELECT user_id, MIN(device_id) AS device_id FROM prekeys GROUP BY user_id) keep ON keep.user_id = p.user_id
+WHERE p.device_id != keep.device_id;
+ALTER TABLE prekeys DROP FOREIGN KEY fk_prekeys_device;
+ALTER TABLE prekeys DROP PRIMARY KEY, DROP COLUMN device_id, ADD PRIMARY KEY (user_id);
+ALTER TABLE prekeys DROP INDEX idx_prekeys_user;
+
+DROP TABLE IF EXISTS devices;
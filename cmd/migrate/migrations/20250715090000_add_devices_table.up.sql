@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS devices (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_devices_user (user_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Every existing account gets one device that inherits its keys and tokens.
+INSERT INTO devices (user_id, name) SELECT id, 'Primary device' FROM users;
+
+ALTER TABLE prekeys ADD COLUMN device_id BIGINT UNSIGNED NULL AFTER user_id;
+UPDATE prekeys p JOIN devices d ON d.user_id = p.user_id SET p.device_id = d.id;
+ALTER TABLE prekeys ADD INDEX idx_prekeys_user (user_id);
+ALTER TABLE prekeys
+    DROP PRIMARY KEY,
+    MODIFY device_id BIGINT UNSIGNED NOT NULL,
+    ADD PRIMARY KEY (device_id),
+    ADD CONSTRAINT fk_prekeys_device FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE;
+
+ALTER TABLE one_time_prekeys ADD COLUMN device_id BIGINT UNSIGNED NULL AFTER user_id;
+UPDATE one_time_prekeys k JOIN devices d ON d.user_id = k.user_id SET k.device_id = d.id;
+ALTER TABLE one_time_prekeys
+    MODIFY device_id BIGINT UNSIGNED NOT NULL,
+    DROP INDEX uq_one_time_prekeys_key,
+    ADD UNIQUE KEY uq_one_time_prekeys_key (device_id, key_id),
+    ADD INDEX idx_one_time_prekeys_device (device_id, id),
+    ADD CONSTRAINT fk_one_time_prekeys_device FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE;
+
+ALTER TABLE signed_prekey_history ADD COLUMN device_id BIGINT UNSIGNED NULL AFTER user_id;
+UPDATE signed_prekey_history h JOIN devices d ON d.user_id = h.user_id SET h.device_id = d.id;
+ALTER TABLE signed_prekey_history
+    MODIFY device_id BIGINT UNSIGNED NOT NULL,
+    ADD INDEX idx_signed_prekey_history_device (device_id, replaced_at),
+    ADD CONSTRAINT fk_signed_prekey_history_device FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE;
+
+ALTER TABLE refresh_tokens ADD COLUMN device_id BIGINT UNSIGNED NULL AFTER user_id;
+UPDATE refresh_tokens t JOIN devices d ON d.user_id = t.user_id SET t.device_id = d.id;
+ALTER TABLE refresh_tokens
+    ADD CONSTRAINT fk_refresh_tokens_device FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE;
+
+ALTER TABLE messages ADD COLUMN sender_device_id BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER sender_id;
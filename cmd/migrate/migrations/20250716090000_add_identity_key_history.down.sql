@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS conversation_partners;
+DROP TABLE IF EXISTS identity_key_history;
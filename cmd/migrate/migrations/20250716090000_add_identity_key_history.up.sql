@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS identity_key_history (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    device_id BIGINT UNSIGNED NOT NULL,
+    identity_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_identity_key_history_device (device_id, id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE
+);
+
+INSERT INTO identity_key_history (user_id, device_id, identity_key, created_at)
+SELECT user_id, device_id, identity_key, updated_at FROM prekeys;
+
+CREATE TABLE IF NOT EXISTS conversation_partners (
+    user_id BIGINT UNSIGNED NOT NULL,
+    partner_id BIGINT UNSIGNED NOT NULL,
+    last_message_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    PRIMARY KEY (user_id, partner_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (partner_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+INSERT IGNORE INTO conversation_partners (user_id, partner_id, last_message_at)
+SELECT sender_id, recipient_id, MAX(created_at) FROM messages WHERE sender_id != recipient_id GROUP BY sender_id, recipient_id;
+
+INSERT IGNORE INTO conversation_partners (user_id, partner_id, last_message_at)
+SELECT recipient_id, sender_id, MAX(created_at) FROM messages WHERE sender_id != recipient_id GROUP BY recipient_id, sender_id;
@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens
+    DROP INDEX idx_refresh_tokens_family,
+    DROP COLUMN family_id,
+    DROP COLUMN used_at,
+    DROP COLUMN revoked_at;
@@ -0,0 +1,13 @@
+-- Every refresh rotates the token. Tokens rotated from the same login share a
+-- family, which is revoked as a whole when a used token shows up again.
+ALTER TABLE refresh_tokens
+    ADD COLUMN family_id CHAR(32) NULL AFTER device_id,
+    ADD COLUMN used_at TIMESTAMP NULL DEFAULT NULL,
+    ADD COLUMN revoked_at TIMESTAMP NULL DEFAULT NULL;
+
+-- Existing tokens each start their own family.
+UPDATE refresh_tokens SET family_id = MD5(token);
+
+ALTER TABLE refresh_tokens
+    MODIFY family_id CHAR(32) NOT NULL,
+    ADD INDEX idx_refresh_tokens_family (family_id);
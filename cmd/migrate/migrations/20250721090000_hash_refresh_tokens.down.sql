@@ -0,0 +1,3 @@
+-- Digests can't be turned back into tokens, and leaving them would make every
+-- digest a usable token. Everyone has to log in again.
+DELETE FROM refresh_tokens;
@@ -0,0 +1,3 @@
+-- Refresh tokens are stored as their SHA-256 digest. Existing tokens keep
+-- working since clients still present the raw value.
+UPDATE refresh_tokens SET token = SHA2(token, 256);
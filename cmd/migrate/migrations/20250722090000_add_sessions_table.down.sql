@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens ADD COLUMN revoked_at TIMESTAMP NULL DEFAULT NULL;
+
+UPDATE refresh_tokens t JOIN sessions s ON s.id = t.family_id SET t.revoked_at = s.revoked_at;
+
+DROP TABLE IF EXISTS sessions;
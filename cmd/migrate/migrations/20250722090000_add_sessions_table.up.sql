@@ -0,0 +1,23 @@
+-- A session is one login, the refresh token family rotated from it. Sessions
+-- are revoked as a whole, so the revocation moves from the tokens to here.
+CREATE TABLE IF NOT EXISTS sessions (
+    id CHAR(32) NOT NULL PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    device_id BIGINT UNSIGNED NULL DEFAULT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL DEFAULT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL DEFAULT NULL,
+    INDEX idx_sessions_user (user_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE
+);
+
+INSERT INTO sessions (id, user_id, device_id, expires_at, revoked_at)
+SELECT family_id, MIN(user_id), MIN(device_id), MAX(expires_at), MAX(revoked_at)
+FROM refresh_tokens
+GROUP BY family_id;
+
+ALTER TABLE refresh_tokens DROP COLUMN revoked_at;
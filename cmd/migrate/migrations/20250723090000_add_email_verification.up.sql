@@ -0,0 +1,17 @@
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP NULL DEFAULT NULL AFTER email;
+
+-- Existing accounts have been logging in with codes sent to their address.
+UPDATE users SET email_verified_at = created_at;
+
+-- Single-use tokens sent by email, e.g. to verify an address. Only a digest
+-- of the token is stored.
+CREATE TABLE IF NOT EXISTS user_tokens (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    purpose VARCHAR(20) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_user_tokens_user (user_id, purpose),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
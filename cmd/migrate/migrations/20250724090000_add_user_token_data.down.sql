@@ -0,0 +1,2 @@
+DELETE FROM user_tokens WHERE purpose = 'change_email';
+ALTER TABLE user_tokens DROP COLUMN data;
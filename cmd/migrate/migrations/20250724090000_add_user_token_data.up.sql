@@ -0,0 +1,2 @@
+-- Extra data a token carries, e.g. the new address of an email change.
+ALTER TABLE user_tokens ADD COLUMN data VARCHAR(255) NOT NULL DEFAULT '' AFTER purpose;
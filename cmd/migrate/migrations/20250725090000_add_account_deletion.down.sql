@@ -0,0 +1,3 @@
+DELETE FROM otp_challenges WHERE purpose != 'login';
+ALTER TABLE otp_challenges DROP COLUMN purpose;
+ALTER TABLE users DROP INDEX idx_users_delete_after, DROP COLUMN delete_after;
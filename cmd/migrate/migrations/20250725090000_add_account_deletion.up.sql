@@ -0,0 +1,9 @@
+-- Accounts asked to be deleted are purged once delete_after has passed,
+-- until then the deletion can be cancelled.
+ALTER TABLE users
+    ADD COLUMN delete_after TIMESTAMP NULL DEFAULT NULL,
+    ADD INDEX idx_users_delete_after (delete_after);
+
+-- Codes are also sent to confirm an account deletion, a challenge only
+-- works for what it was created for.
+ALTER TABLE otp_challenges ADD COLUMN purpose VARCHAR(20) NOT NULL DEFAULT 'login' AFTER method;
@@ -0,0 +1,20 @@
+-- Copies made for each device are merged back into one envelope for all
+-- devices of the recipient. Envelopes encrypted for each device differ in
+-- content and stay as they are.
+INSERT INTO messages (recipient_id, sender_id, sender_device_id, device_id, content, created_at)
+SELECT recipient_id, sender_id, sender_device_id, 0, ANY_VALUE(content), created_at
+FROM messages
+GROUP BY recipient_id, sender_id, sender_device_id, created_at, SHA2(content, 256)
+HAVING COUNT(*) > 1
+ORDER BY MIN(id);
+
+DELETE m FROM messages m
+JOIN messages merged ON merged.device_id = 0
+    AND merged.recipient_id = m.recipient_id
+    AND merged.sender_id = m.sender_id
+    AND merged.sender_device_id = m.sender_device_id
+    AND merged.created_at = m.created_at
+    AND merged.content = m.content
+WHERE m.device_id != 0;
+
+ALTER TABLE messages DROP INDEX idx_messages_device;
@@ -0,0 +1,12 @@
+-- Every envelope is queued for exactly one device, so one device
+-- acknowledging it can't take it away from the others. Envelopes still
+-- queued for any device get a copy per device of the recipient.
+INSERT INTO messages (recipient_id, sender_id, sender_device_id, device_id, content, created_at)
+SELECT m.recipient_id, m.sender_id, m.sender_device_id, d.id, m.content, m.created_at
+FROM messages m JOIN devices d ON d.user_id = m.recipient_id
+WHERE m.device_id = 0
+ORDER BY m.id, d.id;
+
+DELETE FROM messages WHERE device_id = 0;
+
+ALTER TABLE messages ADD INDEX idx_messages_device (recipient_id, device_id, id);
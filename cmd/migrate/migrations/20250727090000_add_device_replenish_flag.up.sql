@@ -0,0 +1,9 @@
+-- Set when a device's one-time prekey pool runs low, cleared once it uploads
+-- enough new ones, so devices that were offline still get asked.
+ALTER TABLE devices ADD COLUMN replenish_keys BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Devices that have a bundle but no one-time prekeys, e.g. because the ones
+-- uploaded without key IDs were dropped, are asked for new ones.
+UPDATE devices d SET replenish_keys = TRUE
+WHERE EXISTS (SELECT 1 FROM prekeys p WHERE p.device_id = d.id)
+AND NOT EXISTS (SELECT 1 FROM one_time_prekeys k WHERE k.device_id = d.id);
@@ -0,0 +1,2 @@
+ALTER TABLE messages DROP FOREIGN KEY fk_messages_device;
+ALTER TABLE messages DROP INDEX fk_messages_device;
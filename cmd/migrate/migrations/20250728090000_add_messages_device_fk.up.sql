@@ -0,0 +1,9 @@
+-- Envelopes go away with the device they were encrypted for. Ones queued for
+-- a device that doesn't exist or isn't the recipient's could never be
+-- acknowledged.
+DELETE m FROM messages m
+LEFT JOIN devices d ON d.id = m.device_id
+WHERE d.id IS NULL OR d.user_id != m.recipient_id;
+
+ALTER TABLE messages
+    ADD CONSTRAINT fk_messages_device FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE;
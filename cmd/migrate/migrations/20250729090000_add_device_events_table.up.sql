@@ -0,0 +1,13 @@
+-- Events like identity key changes are queued for every device they concern
+-- until it acknowledges them, so devices that were offline still get them.
+CREATE TABLE IF NOT EXISTS device_events (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT UNSIGNED NOT NULL,
+    device_id BIGINT UNSIGNED NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    data JSON NOT NULL,
+    created_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    INDEX idx_device_events_device (user_id, device_id, id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (device_id) REFERENCES devices (id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- Passkeys with longer IDs don't fit anymore and have to be registered again.
+DELETE FROM webauthn_credentials WHERE LENGTH(credential_id) > 255;
+ALTER TABLE webauthn_credentials MODIFY credential_id VARBINARY(255) NOT NULL;
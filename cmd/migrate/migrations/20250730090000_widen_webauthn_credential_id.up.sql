@@ -0,0 +1,2 @@
+-- WebAuthn allows credential IDs of up to 1023 bytes.
+ALTER TABLE webauthn_credentials MODIFY credential_id VARBINARY(1023) NOT NULL;
@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,7 +17,85 @@ type Config struct {
 	DBPassword string
 	DBAddress  string
 	DBName     string
-	JWTSecret  string
+
+	// JWTSigningKey is the PEM file of the Ed25519 key tokens are signed
+	// with. JWTVerificationKeys are the public keys of retired signing keys,
+	// kept until the tokens they signed have expired.
+	JWTSigningKey       string
+	JWTVerificationKeys []string
+
+	// JWTIssuer goes into the iss claim, JWTLeeway is the clock skew allowed
+	// when checking token lifetimes.
+	JWTIssuer string
+	JWTLeeway time.Duration
+
+	// PrekeyLowWatermark is the one-time prekey count under which clients
+	// are asked to upload more.
+	PrekeyLowWatermark int
+
+	// SignedPrekeyGracePeriod is how long a replaced signed prekey is kept.
+	SignedPrekeyGracePeriod time.Duration
+
+	// Mailer selects how mail is delivered: "smtp", or "log" for local
+	// development.
+	Mailer       string
+	MailLogFile  string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// AppURL is where links in emails point to, e.g. APP_URL/verify-email.
+	AppURL string
+
+	EmailVerificationTTL time.Duration
+	PasswordResetTTL     time.Duration
+	// UnverifiedAccountMaxAge is how long an account may stay unverified
+	// before it is deleted, 0 keeps them.
+	UnverifiedAccountMaxAge time.Duration
+	// CleanupInterval is how often expired data is deleted.
+	CleanupInterval time.Duration
+	// AccountDeletionGracePeriod is how long a deleted account can still be
+	// restored, 0 deletes it right away.
+	AccountDeletionGracePeriod time.Duration
+
+	// New passwords need PasswordMinLength to PasswordMaxLength characters
+	// and a strength score of at least PasswordMinScore (0 to 4). With
+	// BreachedPasswordsDir set they are also checked against an offline copy
+	// of the Pwned Passwords range files.
+	PasswordMinLength    int
+	PasswordMaxLength    int
+	PasswordMinScore     int
+	BreachedPasswordsDir string
+
+	// OTPInResponse also returns the login code in the API response. Only
+	// meant for local development.
+	OTPInResponse bool
+
+	// OTPMaxAttempts is how many wrong codes lock an OTP challenge.
+	OTPMaxAttempts int
+	OTPLength      int
+	OTPAlphabet    string
+	OTPTTL         time.Duration
+
+	// TOTPIssuer is the name authenticator apps show next to the account.
+	TOTPIssuer string
+
+	// WebAuthnRPID is the domain passkeys are bound to, WebAuthnOrigins the
+	// origins clients may run ceremonies from.
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+
+	// WebSocketOrigins are the browser origins allowed to open the WebSocket.
+	// Clients that send no Origin, like the mobile apps, are always allowed.
+	WebSocketOrigins []string
+
+	// SessionCacheTTL is how long session checks of access tokens are cached.
+	// A revoked session is dropped from the cache right away, but other
+	// server instances only notice once their entry expires.
+	SessionCacheTTL time.Duration
 }
 
 var Envs = initConfig()
@@ -28,6 +109,117 @@ func initConfig() Config {
 		DBPassword: os.Getenv("DB_PASSWORD"),
 		DBAddress:  fmt.Sprintf("%s:%s", os.Getenv("DB_HOST"), os.Getenv("DB_PORT")),
 		DBName:     os.Getenv("DB_NAME"),
-		JWTSecret:  os.Getenv("JWT_SECRET"),
+
+		JWTSigningKey:       os.Getenv("JWT_SIGNING_KEY"),
+		JWTVerificationKeys: getEnvAsList("JWT_VERIFICATION_KEYS", nil),
+		JWTIssuer:           getEnv("JWT_ISSUER", "serra"),
+		JWTLeeway:           getEnvAsDuration("JWT_LEEWAY", 30*time.Second),
+
+		PrekeyLowWatermark:      getEnvAsInt("PREKEY_LOW_WATERMARK", 10),
+		SignedPrekeyGracePeriod: getEnvAsDuration("SIGNED_PREKEY_GRACE_PERIOD", 7*24*time.Hour),
+
+		Mailer:       getEnv("MAILER", "log"),
+		MailLogFile:  os.Getenv("MAIL_LOG_FILE"),
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:     os.Getenv("SMTP_FROM"),
+
+		AppURL:                  os.Getenv("APP_URL"),
+		EmailVerificationTTL:    getEnvAsDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		PasswordResetTTL:        getEnvAsDuration("PASSWORD_RESET_TTL", time.Hour),
+		UnverifiedAccountMaxAge: getEnvAsDuration("UNVERIFIED_ACCOUNT_MAX_AGE", 7*24*time.Hour),
+		CleanupInterval:         getEnvAsDuration("CLEANUP_INTERVAL", time.Hour),
+
+		AccountDeletionGracePeriod: getEnvAsDuration("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour),
+
+		PasswordMinLength:    getEnvAsInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxLength:    getEnvAsInt("PASSWORD_MAX_LENGTH", 72),
+		PasswordMinScore:     getEnvAsInt("PASSWORD_MIN_SCORE", 2),
+		BreachedPasswordsDir: getEnv("BREACHED_PASSWORDS_DIR", ""),
+
+		OTPInResponse:  getEnvAsBool("OTP_IN_RESPONSE", false),
+		OTPMaxAttempts: getEnvAsInt("OTP_MAX_ATTEMPTS", 5),
+		OTPLength:      getEnvAsInt("OTP_LENGTH", 6),
+		OTPAlphabet:    getEnv("OTP_ALPHABET", "0123456789"),
+		OTPTTL:         getEnvAsDuration("OTP_TTL", 5*time.Minute),
+
+		TOTPIssuer: getEnv("TOTP_ISSUER", "Serra"),
+
+		WebAuthnRPID:    getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:  getEnv("WEBAUTHN_RP_NAME", "Serra"),
+		WebAuthnOrigins: getEnvAsList("WEBAUTHN_ORIGINS", []string{"http://localhost:8080"}),
+
+		WebSocketOrigins: getEnvAsList("WEBSOCKET_ORIGINS", []string{"http://localhost:8080"}),
+
+		SessionCacheTTL: getEnvAsDuration("SESSION_CACHE_TTL", 30*time.Second),
 	}
 }
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return fallback
+}
+
+func getEnvAsInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+
+	return i
+}
+
+func getEnvAsDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+
+	return d
+}
+
+func getEnvAsBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+
+	return b
+}
+
+// getEnvAsList reads a comma separated list.
+func getEnvAsList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,19 @@
+package mailer
+
+import (
+	"fmt"
+	"serra/config"
+	"serra/types"
+)
+
+// New returns the mailer selected by the MAILER setting.
+func New(cfg config.Config) (types.Mailer, error) {
+	switch cfg.Mailer {
+	case "smtp":
+		return NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom), nil
+	case "log", "":
+		return NewLogMailer(cfg.MailLogFile), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+	}
+}
@@ -0,0 +1,198 @@
+package message
+
+import (
+	"log"
+	"serra/types"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 64 * 1024
+	sendBufferSize = 64
+)
+
+// Client is a single WebSocket session of an authenticated user.
+type Client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	userID    int64
+	deviceID  int64
+	sessionID string
+	send      chan outbound
+	// flushedID is the last envelope written from the backlog. The write
+	// pump skips live copies of envelopes up to it.
+	flushedID int64
+	// flushedEventID does the same for queued events.
+	flushedEventID int64
+}
+
+// outbound is an encoded event waiting for the write pump. envelopeID is set
+// for relayed envelopes, eventID for queued events.
+type outbound struct {
+	data       []byte
+	envelopeID int64
+	eventID    int64
+}
+
+// frame is what clients send over the socket.
+type frame struct {
+	Type        string  `json:"type"`
+	RecipientID int64   `json:"recipient_id"`
+	DeviceID    int64   `json:"device_id"`
+	Content     []byte  `json:"content"`
+	IDs         []int64 `json:"ids"`
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var f frame
+		if err := c.conn.ReadJSON(&f); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("ws: read error:", err)
+			}
+			return
+		}
+
+		switch f.Type {
+		case "message":
+			c.handleMessage(f)
+		case "ack":
+			c.handleAck(f)
+		case "ack_events":
+			c.handleAckEvents(f)
+		default:
+			c.hub.sendTo(c, types.Event{Type: "error", Data: "unknown frame type"})
+		}
+	}
+}
+
+func (c *Client) handleMessage(f frame) {
+	if f.RecipientID <= 0 || f.DeviceID <= 0 || len(f.Content) == 0 {
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "recipient_id, device_id and content are required"})
+		return
+	}
+
+	// Envelopes for devices that don't exist would never be acknowledged.
+	ok, err := c.hub.store.HasDevice(f.RecipientID, f.DeviceID)
+	if err != nil {
+		log.Println("ws: failed to look up recipient device:", err)
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "failed to deliver message"})
+		return
+	}
+	if !ok {
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "device_id is not a device of recipient_id"})
+		return
+	}
+
+	envelope := types.Envelope{
+		SenderID:       c.userID,
+		SenderDeviceID: c.deviceID,
+		RecipientID:    f.RecipientID,
+		DeviceID:       f.DeviceID,
+		Content:        f.Content,
+		Timestamp:      time.Now().UTC(),
+	}
+
+	if err := c.hub.relay(&envelope); err != nil {
+		log.Println("ws: failed to relay message:", err)
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "failed to deliver message"})
+		return
+	}
+
+	c.hub.sendTo(c, types.Event{Type: "sent", Data: map[string]any{
+		"id":        envelope.ID,
+		"timestamp": envelope.Timestamp,
+	}})
+}
+
+func (c *Client) handleAck(f frame) {
+	if _, err := c.hub.store.DeleteMessages(c.userID, c.deviceID, f.IDs); err != nil {
+		log.Println("ws: failed to acknowledge messages:", err)
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "failed to acknowledge messages"})
+	}
+}
+
+func (c *Client) handleAckEvents(f frame) {
+	if _, err := c.hub.store.DeleteEvents(c.userID, c.deviceID, f.IDs); err != nil {
+		log.Println("ws: failed to acknowledge events:", err)
+		c.hub.sendTo(c, types.Event{Type: "error", Data: "failed to acknowledge events"})
+	}
+}
+
+// deliver queues data for the write pump. Callers must hold the hub lock so
+// the send channel can't be closed underneath them.
+func (c *Client) deliver(o outbound) {
+	select {
+	case c.send <- o:
+	default:
+		// Slow consumer, drop the connection and let the client reconnect.
+		go c.conn.Close()
+	}
+}
+
+// disconnect tells the client its session was revoked and closes the
+// connection. WriteControl may run next to the write pump, the read pump
+// unregisters the client once the connection is gone.
+func (c *Client) disconnect() {
+	go func() {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		c.conn.Close()
+	}()
+}
+
+// write sends an event straight to the connection, bypassing the send
+// buffer. Only one goroutine may write at a time, so it is only used before
+// writePump starts.
+func (c *Client) write(event types.Event) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(event)
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case o, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if (o.envelopeID != 0 && o.envelopeID <= c.flushedID) ||
+				(o.eventID != 0 && o.eventID <= c.flushedEventID) {
+				// Already sent with the backlog.
+				continue
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, o.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package message
+
+import (
+	"encoding/json"
+	"log"
+	"serra/config"
+	"serra/types"
+	"sync"
+)
+
+// pendingLimit caps how many queued envelopes are handed over at once.
+const pendingLimit = 500
+
+// Hub keeps track of every live WebSocket session, grouped by user.
+type Hub struct {
+	store   types.MessageStore
+	mu      sync.RWMutex
+	clients map[int64]map[*Client]struct{}
+}
+
+func NewHub(store types.MessageStore) *Hub {
+	return &Hub{
+		store:   store,
+		clients: make(map[int64]map[*Client]struct{}),
+	}
+}
+
+func (h *Hub) register(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions, ok := h.clients[c.userID]
+	if !ok {
+		sessions = make(map[*Client]struct{})
+		h.clients[c.userID] = sessions
+	}
+	sessions[c] = struct{}{}
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions, ok := h.clients[c.userID]
+	if !ok {
+		return
+	}
+	if _, ok := sessions[c]; !ok {
+		return
+	}
+
+	delete(sessions, c)
+	close(c.send)
+	if len(sessions) == 0 {
+		delete(h.clients, c.userID)
+	}
+}
+
+// DisconnectSession closes the sockets opened with a revoked login session.
+func (h *Hub) DisconnectSession(sessionID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, sessions := range h.clients {
+		for c := range sessions {
+			if c.sessionID == sessionID {
+				c.disconnect()
+			}
+		}
+	}
+}
+
+// DisconnectUser closes every socket of the user, after all their login
+// sessions were revoked.
+func (h *Hub) DisconnectUser(userID int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients[userID] {
+		c.disconnect()
+	}
+}
+
+// Notify pushes an event to every connected session of the user.
+func (h *Hub) Notify(userID int64, event types.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("hub: failed to encode event:", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients[userID] {
+		c.deliver(outbound{data: data})
+	}
+}
+
+// NotifyDevice pushes an event to the sessions of one device of the user.
+func (h *Hub) NotifyDevice(userID, deviceID int64, event types.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("hub: failed to encode event:", err)
+		return
+	}
+
+	h.notifyDevice(userID, deviceID, outbound{data: data})
+}
+
+func (h *Hub) notifyDevice(userID, deviceID int64, o outbound) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients[userID] {
+		if c.deviceID == deviceID {
+			c.deliver(o)
+		}
+	}
+}
+
+// NotifyUsers queues an event for every device of the users until it is
+// acknowledged and pushes it to the sessions open right now.
+func (h *Hub) NotifyUsers(userIDs []int64, event types.Event) {
+	queued, err := h.store.QueueEvent(userIDs, event)
+	if err != nil {
+		// Reach at least whoever is online.
+		log.Println("hub: failed to queue event:", err)
+		for _, userID := range userIDs {
+			h.Notify(userID, event)
+		}
+		return
+	}
+
+	for _, q := range queued {
+		data, err := json.Marshal(q.Event)
+		if err != nil {
+			log.Println("hub: failed to encode event:", err)
+			continue
+		}
+		h.notifyDevice(q.UserID, q.DeviceID, outbound{data: data, eventID: q.Event.ID})
+	}
+}
+
+// NotifyPartners queues an event for everyone the user has exchanged
+// messages with, see NotifyUsers.
+func (h *Hub) NotifyPartners(userID int64, event types.Event) {
+	partners, err := h.store.GetConversationPartners(userID)
+	if err != nil {
+		log.Println("hub: failed to load conversation partners:", err)
+		return
+	}
+
+	h.NotifyUsers(partners, event)
+}
+
+// relay queues the envelope until the recipient acknowledges it and pushes it
+// to the sessions of the device it was encrypted for that are open right now.
+func (h *Hub) relay(e *types.Envelope) error {
+	if err := h.store.SaveMessage(e); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(types.Event{Type: "message", Data: e})
+	if err != nil {
+		log.Println("hub: failed to encode event:", err)
+		return nil
+	}
+	h.notifyDevice(e.RecipientID, e.DeviceID, outbound{data: data, envelopeID: e.ID})
+
+	return nil
+}
+
+// flushPending writes the envelopes queued after afterID straight to the
+// connection, page by page, and returns the ID of the last one. It must run
+// before the session's writePump starts.
+func (h *Hub) flushPending(c *Client, afterID int64) (int64, error) {
+	for {
+		messages, err := h.store.GetPendingMessages(c.userID, c.deviceID, afterID, pendingLimit)
+		if err != nil {
+			return afterID, err
+		}
+
+		for _, e := range messages {
+			if err := c.write(types.Event{Type: "message", Data: e}); err != nil {
+				return afterID, err
+			}
+			afterID = e.ID
+		}
+
+		if len(messages) < pendingLimit {
+			return afterID, nil
+		}
+	}
+}
+
+// flushEvents writes the events queued for the device straight to the
+// connection, page by page, and returns the ID of the last one. Like
+// flushPending it must run before the session's writePump starts.
+func (h *Hub) flushEvents(c *Client) (int64, error) {
+	var afterID int64
+	for {
+		events, err := h.store.GetPendingEvents(c.userID, c.deviceID, afterID, pendingLimit)
+		if err != nil {
+			return afterID, err
+		}
+
+		for _, e := range events {
+			if err := c.write(e); err != nil {
+				return afterID, err
+			}
+			afterID = e.ID
+		}
+
+		if len(events) < pendingLimit {
+			return afterID, nil
+		}
+	}
+}
+
+// flushReplenish repeats a pending request to top up one-time prekeys,
+// which the device may have missed while it was offline. Like flushPending
+// it must run before the session's writePump starts.
+func (h *Hub) flushReplenish(c *Client) error {
+	pending, count, err := h.store.GetReplenishKeys(c.deviceID)
+	if err != nil || !pending {
+		return err
+	}
+
+	return c.write(replenishEvent(count))
+}
+
+func replenishEvent(count int) types.Event {
+	return types.Event{Type: "replenish_keys", Data: map[string]any{
+		"count":         count,
+		"low_watermark": config.Envs.PrekeyLowWatermark,
+	}}
+}
+
+// sendTo pushes an event to a single session, e.g. an error reply.
+func (h *Hub) sendTo(c *Client, event types.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("hub: failed to encode event:", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, ok := h.clients[c.userID][c]; ok {
+		c.deliver(outbound{data: data})
+	}
+}
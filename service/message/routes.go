@@ -0,0 +1,229 @@
+package message
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"serra/config"
+	"serra/types"
+	"serra/utils"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// webSocketProtocol is the subprotocol the server speaks. Browsers need it
+	// offered next to the token protocol, the handshake fails if the server
+	// doesn't select one of the offered protocols.
+	webSocketProtocol = "serra"
+	// tokenProtocolPrefix carries the access token for browsers, which can't
+	// set an Authorization header on a WebSocket handshake.
+	tokenProtocolPrefix = "bearer."
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{webSocketProtocol},
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin lets through same-origin pages, the configured web clients and
+// clients that aren't browsers and send no Origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return slices.Contains(config.Envs.WebSocketOrigins, origin)
+}
+
+// tokenFromProtocol moves an access token sent as a "bearer.<token>"
+// subprotocol into the Authorization header for JWTAuth.
+func tokenFromProtocol(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			for _, protocol := range websocket.Subprotocols(r) {
+				if token, ok := strings.CutPrefix(protocol, tokenProtocolPrefix); ok {
+					r.Header.Set("Authorization", "Bearer "+token)
+					break
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Handler struct {
+	store types.MessageStore
+	hub   *Hub
+}
+
+func NewHandler(store types.MessageStore, hub *Hub) *Handler {
+	return &Handler{store: store, hub: hub}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.Handle("/ws", tokenFromProtocol(utils.JWTAuth(http.HandlerFunc(h.handleWebSocket)))).Methods("GET")
+	router.Handle("/messages", utils.JWTAuth(http.HandlerFunc(h.handleGetMessages))).Methods("GET")
+	router.Handle("/messages/ack", utils.JWTAuth(http.HandlerFunc(h.handleAckMessages))).Methods("POST")
+	router.Handle("/events/ack", utils.JWTAuth(http.HandlerFunc(h.handleAckEvents))).Methods("POST")
+}
+
+func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+	sessionID := r.Context().Value(utils.SessionIDKey).(string)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote the HTTP error response.
+		log.Println("ws: upgrade failed:", err)
+		return
+	}
+
+	client := &Client{
+		hub:       h.hub,
+		conn:      conn,
+		userID:    userID,
+		deviceID:  deviceID,
+		sessionID: sessionID,
+		send:      make(chan outbound, sendBufferSize),
+	}
+	// The backlog is written before the session is registered, it can be far
+	// larger than the send buffer. Whatever was queued meanwhile is caught up
+	// on once live events are buffered, the write pump drops their duplicates.
+	lastID, err := h.hub.flushPending(client, 0)
+	if err != nil {
+		log.Println("ws: failed to hand over pending messages:", err)
+		conn.Close()
+		return
+	}
+
+	h.hub.register(client)
+
+	client.flushedID, err = h.hub.flushPending(client, lastID)
+	if err != nil {
+		log.Println("ws: failed to hand over pending messages:", err)
+		h.hub.unregister(client)
+		conn.Close()
+		return
+	}
+
+	client.flushedEventID, err = h.hub.flushEvents(client)
+	if err != nil {
+		log.Println("ws: failed to hand over pending events:", err)
+		h.hub.unregister(client)
+		conn.Close()
+		return
+	}
+
+	if err := h.hub.flushReplenish(client); err != nil {
+		log.Println("ws: failed to repeat the replenish request:", err)
+		h.hub.unregister(client)
+		conn.Close()
+		return
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func (h *Handler) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+
+	messages, err := h.store.GetPendingMessages(userID, deviceID, 0, pendingLimit)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	events, err := h.store.GetPendingEvents(userID, deviceID, 0, pendingLimit)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	response := map[string]any{
+		"messages": messages,
+		"events":   events,
+	}
+
+	// Devices that only poll learn here that their prekey pool runs low.
+	pending, count, err := h.store.GetReplenishKeys(deviceID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if pending {
+		response["replenish_keys"] = replenishEvent(count).Data
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) handleAckMessages(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+
+	var payload struct {
+		IDs []int64 `json:"ids" validate:"required,min=1,dive,gt=0"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	deleted, err := h.store.DeleteMessages(userID, deviceID, payload.IDs)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"acknowledged": deleted,
+	})
+}
+
+func (h *Handler) handleAckEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+
+	var payload struct {
+		IDs []int64 `json:"ids" validate:"required,min=1,dive,gt=0"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	deleted, err := h.store.DeleteEvents(userID, deviceID, payload.IDs)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"acknowledged": deleted,
+	})
+}
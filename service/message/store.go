@@ -0,0 +1,243 @@
+package message
+
+import (
+	"database/sql"
+	"encoding/json"
+	"serra/types"
+	"strings"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) SaveMessage(e *types.Envelope) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO messages (recipient_id, sender_id, sender_device_id, device_id, content, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.RecipientID, e.SenderID, e.SenderDeviceID, e.DeviceID, e.Content, e.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	// Remember who talks to whom so key changes can be announced to them.
+	if e.SenderID != e.RecipientID {
+		_, err = tx.Exec(`INSERT INTO conversation_partners (user_id, partner_id, last_message_at)
+		VALUES (?, ?, ?), (?, ?, ?)
+		ON DUPLICATE KEY UPDATE last_message_at = VALUES(last_message_at)`,
+			e.SenderID, e.RecipientID, e.Timestamp, e.RecipientID, e.SenderID, e.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// GetPendingMessages returns the envelopes queued for the device, oldest
+// first, starting after afterID.
+func (s *Store) GetPendingMessages(recipientID, deviceID, afterID int64, limit int) ([]types.Envelope, error) {
+	rows, err := s.db.Query(`SELECT id, sender_id, sender_device_id, recipient_id, device_id, content, created_at
+	FROM messages
+	WHERE recipient_id = ? AND device_id = ? AND id > ?
+	ORDER BY id
+	LIMIT ?`, recipientID, deviceID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []types.Envelope{}
+	for rows.Next() {
+		var e types.Envelope
+		if err := rows.Scan(&e.ID, &e.SenderID, &e.SenderDeviceID, &e.RecipientID, &e.DeviceID, &e.Content, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, e)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *Store) DeleteMessages(recipientID, deviceID int64, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Scope by recipient device so nobody can acknowledge someone else's envelopes.
+	args := []any{recipientID, deviceID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+
+	res, err := s.db.Exec(`DELETE FROM messages WHERE recipient_id = ? AND device_id = ? AND id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// QueueEvent stores a copy of the event for every device of the users and
+// returns the copies with their IDs.
+func (s *Store) QueueEvent(userIDs []int64, event types.Event) ([]types.DeviceEvent, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []any{}
+	for _, id := range userIDs {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(userIDs)), ",")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT user_id, id FROM devices WHERE user_id IN (`+placeholders+`) ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := []types.DeviceEvent{}
+	for rows.Next() {
+		var q types.DeviceEvent
+		if err := rows.Scan(&q.UserID, &q.DeviceID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		queued = append(queued, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range queued {
+		res, err := tx.Exec(`INSERT INTO device_events (user_id, device_id, type, data) VALUES (?, ?, ?, ?)`,
+			queued[i].UserID, queued[i].DeviceID, event.Type, data)
+		if err != nil {
+			return nil, err
+		}
+
+		queued[i].Event = event
+		queued[i].Event.ID, _ = res.LastInsertId()
+	}
+
+	return queued, tx.Commit()
+}
+
+// GetPendingEvents returns the events queued for the device, oldest first,
+// starting after afterID.
+func (s *Store) GetPendingEvents(userID, deviceID, afterID int64, limit int) ([]types.Event, error) {
+	rows, err := s.db.Query(`SELECT id, type, data
+	FROM device_events
+	WHERE user_id = ? AND device_id = ? AND id > ?
+	ORDER BY id
+	LIMIT ?`, userID, deviceID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []types.Event{}
+	for rows.Next() {
+		var (
+			e    types.Event
+			data []byte
+		)
+		if err := rows.Scan(&e.ID, &e.Type, &data); err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(data)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *Store) DeleteEvents(userID, deviceID int64, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := []any{userID, deviceID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+
+	res, err := s.db.Exec(`DELETE FROM device_events WHERE user_id = ? AND device_id = ? AND id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// HasDevice reports whether the device belongs to the user.
+func (s *Store) HasDevice(userID, deviceID int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM devices WHERE id = ? AND user_id = ?)`, deviceID, userID).Scan(&exists)
+	return exists, err
+}
+
+// GetReplenishKeys reports whether the device was asked to top up its
+// one-time prekeys and hasn't yet, along with how many it has left.
+func (s *Store) GetReplenishKeys(deviceID int64) (bool, int, error) {
+	var (
+		pending bool
+		count   int
+	)
+	err := s.db.QueryRow(`SELECT d.replenish_keys, COUNT(k.id)
+	FROM devices d
+	LEFT JOIN one_time_prekeys k ON k.device_id = d.id
+	WHERE d.id = ?
+	GROUP BY d.id`, deviceID).Scan(&pending, &count)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+
+	return pending, count, err
+}
+
+func (s *Store) GetConversationPartners(userID int64) ([]int64, error) {
+	rows, err := s.db.Query(`SELECT partner_id FROM conversation_partners WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partners := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		partners = append(partners, id)
+	}
+
+	return partners, rows.Err()
+}
@@ -0,0 +1,84 @@
+package user
+
+import (
+	"log"
+	"serra/types"
+	"serra/utils"
+	"time"
+)
+
+// StartCleanup periodically deletes unverified accounts past maxAge, accounts
+// whose deletion grace period is over, expired email tokens and spent login
+// challenges. A maxAge of 0 keeps unverified accounts.
+func StartCleanup(store types.UserStore, notifier types.Notifier, interval, maxAge time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			cleanup(store, notifier, maxAge)
+		}
+	}()
+}
+
+func cleanup(store types.UserStore, notifier types.Notifier, maxAge time.Duration) {
+	if maxAge > 0 {
+		n, err := store.DeleteUnverifiedUsers(time.Now().Add(-maxAge))
+		if err != nil {
+			log.Println("cleanup: failed to delete unverified accounts:", err)
+		} else if n > 0 {
+			log.Printf("cleanup: deleted %d unverified accounts", n)
+		}
+	}
+
+	ids, err := store.GetUsersDueForDeletion(time.Now())
+	if err != nil {
+		log.Println("cleanup: failed to load accounts due for deletion:", err)
+	}
+	deleted := 0
+	for _, id := range ids {
+		if err := purgeUser(store, notifier, id); err != nil {
+			log.Printf("cleanup: failed to delete account %d: %v", id, err)
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("cleanup: deleted %d accounts past their grace period", deleted)
+	}
+
+	if _, err := store.DeleteExpiredUserTokens(); err != nil {
+		log.Println("cleanup: failed to delete expired tokens:", err)
+	}
+
+	if _, err := store.DeleteExpiredOTPChallenges(); err != nil {
+		log.Println("cleanup: failed to delete expired OTP challenges:", err)
+	}
+
+	if _, err := store.DeleteExpiredWebAuthnChallenges(); err != nil {
+		log.Println("cleanup: failed to delete expired passkey challenges:", err)
+	}
+}
+
+// purgeUser deletes an account for good and tells its conversation partners
+// once it is gone. The event is queued for those who are offline. The server
+// keeps no media to purge: profile pictures are links to elsewhere, and
+// whatever clients send, attachments included, travels inside the encrypted
+// envelopes, which are deleted with the account.
+func purgeUser(store types.UserStore, notifier types.Notifier, userID int64) error {
+	partners, err := store.DeleteUser(userID)
+	if err != nil {
+		return err
+	}
+	utils.InvalidateUserSessions(userID)
+
+	notifier.NotifyUsers(partners, types.Event{Type: "user_deleted", Data: map[string]any{
+		"user_id": userID,
+	}})
+
+	return nil
+}
@@ -3,11 +3,14 @@ package user
 import (
 	"errors"
 	"fmt"
-	"math/rand/v2"
+	"io"
+	"log"
 	"net/http"
+	"serra/config"
 	"serra/types"
 	"serra/utils"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,28 +18,58 @@ import (
 )
 
 type Handler struct {
-	store types.UserStore
+	store     types.UserStore
+	notifier  types.Notifier
+	mailer    types.Mailer
+	otp       *utils.OTPService
+	passwords *utils.PasswordPolicy
 }
 
-func NewHandler(store types.UserStore) *Handler {
-	return &Handler{store: store}
+func NewHandler(store types.UserStore, notifier types.Notifier, mailer types.Mailer, otp *utils.OTPService, passwords *utils.PasswordPolicy) *Handler {
+	return &Handler{store: store, notifier: notifier, mailer: mailer, otp: otp, passwords: passwords}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/register", h.handleRegister).Methods("POST")
+	router.HandleFunc("/verify-email", h.handleVerifyEmail).Methods("POST")
+	router.HandleFunc("/verify-email/resend", h.handleResendVerification).Methods("POST")
+	router.HandleFunc("/password/forgot", h.handleForgotPassword).Methods("POST")
+	router.HandleFunc("/password/reset", h.handleResetPassword).Methods("POST")
 	router.HandleFunc("/login", h.handleLogin).Methods("POST")
 	router.HandleFunc("/verify-otp", h.handleVerifyOTP).Methods("POST")
 	router.HandleFunc("/refresh-token", h.handleRefreshToken).Methods("POST")
+	router.Handle("/logout", utils.JWTAuth(http.HandlerFunc(h.handleLogout))).Methods("POST")
+	router.Handle("/logout-all", utils.JWTAuth(http.HandlerFunc(h.handleLogoutAll))).Methods("POST")
+	router.Handle("/sessions", utils.JWTAuth(http.HandlerFunc(h.handleGetSessions))).Methods("GET")
+	router.Handle("/sessions/{session_id:[0-9a-f]{32}}", utils.JWTAuth(http.HandlerFunc(h.handleRevokeSession))).Methods("DELETE")
 	router.Handle("/onboarding", utils.JWTAuth(http.HandlerFunc(h.handleOnboarding))).Methods("POST")
 	router.Handle("/me", utils.JWTAuth(http.HandlerFunc(h.handleProfile))).Methods("GET")
+	router.Handle("/me", utils.JWTAuth(http.HandlerFunc(h.handleDeleteAccount))).Methods("DELETE")
+	router.Handle("/me/delete/otp", utils.JWTAuth(http.HandlerFunc(h.handleDeleteAccountOTP))).Methods("POST")
+	router.Handle("/me/delete/cancel", utils.JWTAuth(http.HandlerFunc(h.handleCancelAccountDeletion))).Methods("POST")
+	router.Handle("/me/password", utils.JWTAuth(http.HandlerFunc(h.handleChangePassword))).Methods("POST")
+	router.Handle("/me/email", utils.JWTAuth(http.HandlerFunc(h.handleChangeEmail))).Methods("POST")
+	router.HandleFunc("/me/email/confirm", h.handleConfirmEmailChange).Methods("POST")
+	router.Handle("/2fa/totp/enroll", utils.JWTAuth(http.HandlerFunc(h.handleEnrollTOTP))).Methods("POST")
+	router.Handle("/2fa/totp/confirm", utils.JWTAuth(http.HandlerFunc(h.handleConfirmTOTP))).Methods("POST")
+	router.Handle("/2fa/totp", utils.JWTAuth(http.HandlerFunc(h.handleDisableTOTP))).Methods("DELETE")
+	router.Handle("/2fa/totp/recovery-codes", utils.JWTAuth(http.HandlerFunc(h.handleRegenerateRecoveryCodes))).Methods("POST")
+	router.Handle("/webauthn/register/begin", utils.JWTAuth(http.HandlerFunc(h.handleWebAuthnRegisterBegin))).Methods("POST")
+	router.Handle("/webauthn/register/finish", utils.JWTAuth(http.HandlerFunc(h.handleWebAuthnRegisterFinish))).Methods("POST")
+	router.HandleFunc("/webauthn/login/begin", h.handleWebAuthnLoginBegin).Methods("POST")
+	router.HandleFunc("/webauthn/login/finish", h.handleWebAuthnLoginFinish).Methods("POST")
 	router.Handle("/keys/upload", utils.JWTAuth(http.HandlerFunc(h.handleUploadKeys))).Methods("POST")
-	router.HandleFunc("/keys/{user_id}", h.handleGetPrekeyBundle).Methods("GET")
+	router.Handle("/keys/count", utils.JWTAuth(http.HandlerFunc(h.handleCountKeys))).Methods("GET")
+	router.Handle("/keys/signed-prekey", utils.JWTAuth(http.HandlerFunc(h.handleRotateSignedPrekey))).Methods("POST")
+	router.Handle("/keys/signed-prekey", utils.JWTAuth(http.HandlerFunc(h.handleGetSignedPrekeys))).Methods("GET")
+	router.HandleFunc("/keys/{user_id:[0-9]+}", h.handleGetPrekeyBundle).Methods("GET")
+	router.Handle("/keys/{user_id:[0-9]+}/identity", utils.JWTAuth(http.HandlerFunc(h.handleGetIdentityKeys))).Methods("GET")
 }
 
 func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string `json:"email" validate:"required,email"`
-		Password string `json:"password" validate:"required,min=6,max=20"`
+		Password string `json:"password" validate:"required"`
 	}
 
 	if err := utils.ParseJSON(r, &payload); err != nil {
@@ -49,71 +82,1282 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.checkNewPassword(w, payload.Password, payload.Email) {
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user := &types.User{
+		Email:    payload.Email,
+		Password: string(hashed),
+	}
+
+	if err := h.store.CreateUser(user); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The account stays usable without the email, the user can ask for a
+	// new one.
+	if err := h.sendVerificationEmail(user); err != nil {
+		log.Println("register: failed to send verification mail:", err)
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, map[string]any{
+		"message": "Account succesfully created! Check your email to verify your address.",
+	})
+}
+
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.store.UseUserToken(types.TokenPurposeVerifyEmail, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.store.MarkEmailVerified(token.UserID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Email verified",
+	})
+}
+
+// handleResendVerification answers the same for every address, so it can't
+// be used to find out who has an account.
+func (h *Handler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByEmail(payload.Email)
+	if err == nil && user.EmailVerifiedAt == nil {
+		go func() {
+			if err := h.sendVerificationEmail(user); err != nil {
+				log.Println("resend verification: failed to send mail:", err)
+			}
+		}()
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "If the address belongs to an unverified account, a new verification email was sent.",
+	})
+}
+
+// handleForgotPassword emails a reset code. It answers the same whether or
+// not the address has an account.
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Mail is sent in the background so the response time doesn't give away
+	// whether the account exists either.
+	if user, err := h.store.GetUserByEmail(payload.Email); err == nil {
+		go func() {
+			if err := h.sendPasswordResetEmail(user); err != nil {
+				log.Println("forgot password: failed to send mail:", err)
+			}
+		}()
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "If the address has an account, a password reset email was sent.",
+	})
+}
+
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Checked before the token is spent, so a refused password doesn't cost
+	// the user the reset email. The account isn't known yet at this point.
+	if !h.checkNewPassword(w, payload.Password) {
+		return
+	}
+
 	hashed, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
-	user := &types.User{
-		Email:    payload.Email,
-		Password: string(hashed),
-	}
 
-	if err := h.store.CreateUser(user); err != nil {
+	token, err := h.store.UseUserToken(types.TokenPurposePasswordReset, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	userID := token.UserID
+
+	if err := h.store.UpdatePassword(userID, string(hashed)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.InvalidateUserSessions(userID)
+
+	// The reset code arrived by email, which proves the address too.
+	if err := h.store.MarkEmailVerified(userID); err != nil {
+		log.Println("reset password: failed to mark email verified:", err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Password changed. Log in with your new password.",
+	})
+}
+
+// checkNewPassword checks a new password against the policy and writes the
+// violations as a 400 response. userInputs like the email address count
+// against the password's strength.
+func (h *Handler) checkNewPassword(w http.ResponseWriter, password string, userInputs ...string) bool {
+	violations, err := h.passwords.Check(password, userInputs...)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	if len(violations) > 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, map[string]any{
+			"error":      "password does not meet the requirements",
+			"violations": violations,
+		})
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) sendPasswordResetEmail(user *types.User) error {
+	token, err := h.createUserToken(user.ID, types.TokenPurposePasswordReset, "", config.Envs.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Someone asked to reset the password of your Serra account.\n\nReset it with this code:\n\n%s\n\n%sIt expires in %s. If it wasn't you, you can ignore this email, your password stays the same.",
+		token, appLink("reset-password", token), utils.FormatDuration(config.Envs.PasswordResetTTL))
+
+	return h.mailer.Send(user.Email, "Reset your Serra password", body)
+}
+
+func (h *Handler) sendVerificationEmail(user *types.User) error {
+	token, err := h.createUserToken(user.ID, types.TokenPurposeVerifyEmail, "", config.Envs.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Welcome to Serra!\n\nConfirm your email address with this code:\n\n%s\n\n%sIt expires in %s. If you didn't sign up, you can ignore this email.",
+		token, appLink("verify-email", token), utils.FormatDuration(config.Envs.EmailVerificationTTL))
+
+	return h.mailer.Send(user.Email, "Verify your Serra email address", body)
+}
+
+// createUserToken stores a new single-use token and returns it. Only its
+// digest is kept.
+func (h *Handler) createUserToken(userID int64, purpose, data string, ttl time.Duration) (string, error) {
+	token, err := utils.GenerateRandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = h.store.CreateUserToken(&types.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: utils.HashToken(token),
+		Data:      data,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// appLink returns a line with a link into the app for emails, or nothing when
+// APP_URL isn't set.
+func appLink(path, token string) string {
+	if config.Envs.AppURL == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("Or open %s/%s?token=%s\n\n", strings.TrimRight(config.Envs.AppURL, "/"), path, token)
+}
+
+func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByEmail(payload.Email)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		utils.WriteError(w, http.StatusForbidden, errors.New("email not verified"))
+		return
+	}
+
+	response, err := h.startOTPChallenge(user, types.OTPPurposeLogin)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if response["method"] == types.OTPMethodTOTP {
+		response["message"] = "Login successful! Enter the code from your authenticator app."
+	} else {
+		response["message"] = "Login successful! A login code was sent to your email."
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// otpMails are the emails codes are sent with, per challenge purpose. The
+// body takes the code and how long it is valid.
+var otpMails = map[string]struct{ subject, body string }{
+	types.OTPPurposeLogin: {
+		subject: "Your Serra login code",
+		body:    "Your Serra login code is %s.\n\nIt expires in %s. If you didn't try to log in, you can ignore this email.",
+	},
+	types.OTPPurposeDeleteAccount: {
+		subject: "Confirm deleting your Serra account",
+		body:    "Your code to delete your Serra account is %s.\n\nIt expires in %s. If you didn't ask for this, change your password.",
+	},
+}
+
+// startOTPChallenge starts a second-factor check and returns the otp_token and
+// method for the response. Users with an authenticator app prove it with
+// the app, everyone else gets a code by email.
+func (h *Handler) startOTPChallenge(user *types.User, purpose string) (map[string]any, error) {
+	totp, err := h.store.GetTOTPSecret(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp != nil && totp.ConfirmedAt != nil {
+		otpToken, err := h.createOTPChallenge(user, purpose, types.OTPMethodTOTP, "")
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{
+			"otp_token": otpToken,
+			"method":    types.OTPMethodTOTP,
+		}, nil
+	}
+
+	code, err := h.otp.GenerateCode()
+	if err != nil {
+		return nil, err
+	}
+
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	otpToken, err := h.createOTPChallenge(user, purpose, types.OTPMethodEmail, string(codeHash))
+	if err != nil {
+		return nil, err
+	}
+
+	mail := otpMails[purpose]
+	if err := h.mailer.Send(user.Email, mail.subject, fmt.Sprintf(mail.body, code, h.otp.TTLText())); err != nil {
+		log.Println("failed to send OTP mail:", err)
+		return nil, errors.New("failed to send code")
+	}
+
+	response := map[string]any{
+		"otp_token": otpToken,
+		"method":    types.OTPMethodEmail,
+	}
+	if config.Envs.OTPInResponse {
+		response["otp"] = code
+	}
+
+	return response, nil
+}
+
+// createOTPChallenge stores a second-factor challenge and returns the
+// otp_token naming it.
+func (h *Handler) createOTPChallenge(user *types.User, purpose, method, codeHash string) (string, error) {
+	challengeID, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := &types.OTPChallenge{
+		ID:        challengeID,
+		UserID:    user.ID,
+		Method:    method,
+		Purpose:   purpose,
+		CodeHash:  codeHash,
+		ExpiresAt: time.Now().Add(h.otp.TTL()),
+	}
+	if err := h.store.CreateOTPChallenge(challenge); err != nil {
+		return "", err
+	}
+
+	return utils.GenerateOTPToken(user.Email, challenge.ID, h.otp.TTL())
+}
+
+func (h *Handler) handleVerifyOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email      string `json:"email" validate:"required,email"`
+		Code       string `json:"code" validate:"required"`
+		OTPToken   string `json:"otp_token" validate:"required"`
+		DeviceID   int64  `json:"device_id"`
+		DeviceName string `json:"device_name" validate:"max=100"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	emailFromToken, challengeID, err := utils.VerifyOTPToken(payload.OTPToken)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if payload.Email != emailFromToken {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid OTP"))
+		return
+	}
+
+	challenge, ok := h.verifyOTPChallenge(w, challengeID, types.OTPPurposeLogin, payload.Code)
+	if !ok {
+		return
+	}
+
+	user, err := h.store.GetUserByID(challenge.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("user not found"))
+		return
+	}
+
+	h.issueSession(w, r, user, payload.DeviceID, payload.DeviceName, "OTP verified successfully")
+}
+
+// verifyOTPChallenge checks the code against the challenge and spends it. It
+// writes the error response itself.
+func (h *Handler) verifyOTPChallenge(w http.ResponseWriter, challengeID, purpose, code string) (*types.OTPChallenge, bool) {
+	challenge, err := h.store.RecordOTPAttempt(challengeID, config.Envs.OTPMaxAttempts)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+
+	if challenge.Purpose != purpose {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid OTP"))
+		return nil, false
+	}
+
+	if err := h.checkChallengeCode(challenge, code); err != nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, map[string]any{
+			"error":              err.Error(),
+			"attempts_remaining": max(config.Envs.OTPMaxAttempts-challenge.Attempts, 0),
+		})
+		return nil, false
+	}
+
+	if err := h.store.ConsumeOTPChallenge(challenge.ID); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return nil, false
+	}
+
+	return challenge, true
+}
+
+// refreshTokenTTL is how long a refresh token stays valid. Every refresh
+// hands out a new one, so active sessions don't expire.
+const refreshTokenTTL = 7 * 24 * time.Hour
+
+// issueSession finishes a login: it registers the device, starts a session and
+// responds with a new access and refresh token pair.
+func (h *Handler) issueSession(w http.ResponseWriter, r *http.Request, user *types.User, deviceID int64, deviceName, message string) {
+	device, err := h.registerDevice(user.ID, deviceID, deviceName)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sessionID, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	session := &types.Session{
+		ID:        sessionID,
+		UserID:    user.ID,
+		DeviceID:  device.ID,
+		UserAgent: utils.UserAgent(r),
+		IP:        utils.ClientIP(r),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := h.store.CreateSession(session); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = h.store.SaveRefreshToken(&types.RefreshToken{
+		Token:     refreshToken,
+		UserID:    user.ID,
+		DeviceID:  device.ID,
+		FamilyID:  session.ID,
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	token, err := utils.GenerateJWT(user.ID, device.ID, session.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":       message,
+		"token":         token,
+		"refresh_token": refreshToken,
+		"device_id":     device.ID,
+	})
+}
+
+// checkChallengeCode checks the code sent for a login challenge. TOTP
+// challenges also take a recovery code, which is spent on use.
+func (h *Handler) checkChallengeCode(challenge *types.OTPChallenge, code string) error {
+	if challenge.Method != types.OTPMethodTOTP {
+		if !h.otp.ValidCode(code) {
+			return fmt.Errorf("code must be %d characters", h.otp.Length())
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(challenge.CodeHash), []byte(code)); err != nil {
+			return errors.New("invalid OTP")
+		}
+		return nil
+	}
+
+	totp, err := h.store.GetTOTPSecret(challenge.UserID)
+	if err != nil {
+		return err
+	}
+	if totp == nil || totp.ConfirmedAt == nil {
+		return errors.New("authenticator app not enabled")
+	}
+
+	if step, ok := utils.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		return h.store.UseTOTPStep(challenge.UserID, step)
+	}
+
+	if err := h.store.UseRecoveryCode(challenge.UserID, code); err != nil {
+		return errors.New("invalid OTP")
+	}
+
+	return nil
+}
+
+// registerDevice returns the device the client is logging in from. Clients
+// that log in for the first time get a new device, returning clients send
+// the device_id they got back then.
+func (h *Handler) registerDevice(userID, deviceID int64, name string) (*types.Device, error) {
+	if deviceID != 0 {
+		return h.store.GetDevice(userID, deviceID)
+	}
+
+	if name == "" {
+		name = "Unnamed device"
+	}
+
+	return h.store.CreateDevice(userID, name)
+}
+
+func (h *Handler) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	next := &types.RefreshToken{
+		Token:     refreshToken,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := h.store.RotateRefreshToken(payload.RefreshToken, next, utils.UserAgent(r), utils.ClientIP(r)); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			utils.InvalidateSession(next.FamilyID)
+		}
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	token, err := utils.GenerateJWT(next.UserID, next.DeviceID, next.FamilyID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"token":         token,
+		"refresh_token": next.Token,
+	})
+}
+
+// handleLogout ends a session. Without a refresh token it ends the session of
+// the access token.
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	sessionID := r.Context().Value(utils.SessionIDKey).(string)
+
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// The body is optional.
+	if err := utils.ParseJSON(r, &payload); err != nil && !errors.Is(err, io.EOF) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var err error
+	if payload.RefreshToken != "" {
+		sessionID, err = h.store.RevokeSessionByRefreshToken(userID, payload.RefreshToken)
+	} else {
+		err = h.store.RevokeSession(userID, sessionID)
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	utils.InvalidateSession(sessionID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Logged out",
+	})
+}
+
+func (h *Handler) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	revoked, err := h.store.RevokeSessions(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.InvalidateUserSessions(userID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Logged out everywhere",
+		"revoked": revoked,
+	})
+}
+
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	sessionID := r.Context().Value(utils.SessionIDKey).(string)
+
+	sessions, err := h.store.GetSessions(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionID
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"sessions": sessions,
+	})
+}
+
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	sessionID := mux.Vars(r)["session_id"]
+
+	if err := h.store.RevokeSession(userID, sessionID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	utils.InvalidateSession(sessionID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Session revoked",
+	})
+}
+
+func (h *Handler) handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	var payload struct {
+		Username   string `json:"username" validate:"required,min=3"`
+		ProfilePic string `json:"profile_pic"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if payload.ProfilePic == "" {
+		payload.ProfilePic = "https://i.pinimg.com/736x/f9/24/12/f924127a8033eecbb67b0e1509097095.jpg"
+	}
+
+	err := h.store.SetUserProfile(userID, payload.Username, payload.ProfilePic)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Profile updated!",
+	})
+}
+
+func (h *Handler) handleProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"id":           user.ID,
+		"email":        user.Email,
+		"username":     user.Username,
+		"delete_after": user.DeleteAfter,
+	})
+}
+
+// handleChangePassword sets a new password after checking the current one.
+// Every session is revoked, the caller gets a fresh one for its device.
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+
+	var payload struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.CurrentPassword)); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+		return
+	}
+
+	if !h.checkNewPassword(w, payload.NewPassword, user.Email, user.Username) {
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(payload.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.UpdatePassword(userID, string(hashed)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	utils.InvalidateUserSessions(userID)
+
+	h.issueSession(w, r, user, deviceID, "", "Password changed")
+}
+
+// handleChangeEmail mails a confirmation code to the new address. The email
+// is only swapped once the code comes back, so a typo can't lock the user
+// out.
+func (h *Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	var payload struct {
+		NewEmail string `json:"new_email" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+		return
+	}
+
+	if strings.EqualFold(payload.NewEmail, user.Email) {
+		utils.WriteError(w, http.StatusBadRequest, errors.New("that is already your email"))
+		return
+	}
+
+	if _, err := h.store.GetUserByEmail(payload.NewEmail); err == nil {
+		utils.WriteError(w, http.StatusConflict, errors.New("email already registered"))
+		return
+	}
+
+	token, err := h.createUserToken(userID, types.TokenPurposeChangeEmail, payload.NewEmail, config.Envs.EmailVerificationTTL)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := fmt.Sprintf("Someone asked to use this address for their Serra account.\n\nConfirm it with this code:\n\n%s\n\n%sIt expires in %s. If it wasn't you, you can ignore this email.",
+		token, appLink("confirm-email", token), utils.FormatDuration(config.Envs.EmailVerificationTTL))
+	if err := h.mailer.Send(payload.NewEmail, "Confirm your new Serra email address", body); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Check your new email address to confirm the change.",
+	})
+}
+
+// handleConfirmEmailChange swaps the email once the code sent to the new
+// address comes back. The code proves the address, so no login is needed.
+func (h *Handler) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.store.UseUserToken(types.TokenPurposeChangeEmail, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(token.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.store.UpdateEmail(user.ID, token.Data); err != nil {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
+
+	// Let the old address know, in case the account was taken over.
+	go func() {
+		body := fmt.Sprintf("The email address of your Serra account was changed to %s.\n\nIf it wasn't you, reset your password and contact support.", token.Data)
+		if err := h.mailer.Send(user.Email, "Your Serra email address was changed", body); err != nil {
+			log.Println("confirm email change: failed to notify old address:", err)
+		}
+	}()
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Email address changed.",
+	})
+}
+
+// handleDeleteAccountOTP sends a code to confirm an account deletion with,
+// for clients that don't ask for the password again.
+func (h *Handler) handleDeleteAccountOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	response, err := h.startOTPChallenge(user, types.OTPPurposeDeleteAccount)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if response["method"] == types.OTPMethodTOTP {
+		response["message"] = "Enter the code from your authenticator app to delete your account."
+	} else {
+		response["message"] = "A code to delete your account was sent to your email."
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// handleDeleteAccount deletes the account after checking the password or a
+// code from handleDeleteAccountOTP. With a grace period the account is only
+// scheduled for deletion and keeps working until then.
+func (h *Handler) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	var payload struct {
+		Password string `json:"password" validate:"required_without=OTPToken"`
+		OTPToken string `json:"otp_token" validate:"required_without=Password"`
+		Code     string `json:"code" validate:"required_with=OTPToken"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if payload.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+			utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+			return
+		}
+	} else {
+		email, challengeID, err := utils.VerifyOTPToken(payload.OTPToken)
+		if err != nil {
+			utils.WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		if email != user.Email {
+			utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid OTP"))
+			return
+		}
+
+		if _, ok := h.verifyOTPChallenge(w, challengeID, types.OTPPurposeDeleteAccount, payload.Code); !ok {
+			return
+		}
+	}
+
+	grace := config.Envs.AccountDeletionGracePeriod
+	if grace <= 0 {
+		if err := purgeUser(h.store, h.notifier, userID); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, map[string]any{
+			"message": "Account deleted",
+		})
+		return
+	}
+
+	deleteAfter := time.Now().Add(grace)
+	if err := h.store.ScheduleUserDeletion(userID, deleteAfter); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	go func() {
+		body := fmt.Sprintf("Your Serra account will be deleted in %s, together with your keys and messages.\n\nChanged your mind? Log in and cancel the deletion before then.",
+			utils.FormatDuration(grace))
+		if err := h.mailer.Send(user.Email, "Your Serra account will be deleted", body); err != nil {
+			log.Println("delete account: failed to send mail:", err)
+		}
+	}()
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":      "Account scheduled for deletion",
+		"delete_after": deleteAfter,
+	})
+}
+
+func (h *Handler) handleCancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	if err := h.store.CancelUserDeletion(userID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Account deletion cancelled",
+	})
+}
+
+// handleEnrollTOTP starts setting up an authenticator app. Like the other
+// changes to the second factor it asks for the password again, so a stolen
+// access token can't lock the owner out.
+func (h *Handler) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.reauthenticate(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.SaveTOTPSecret(user.ID, secret); err != nil {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(config.Envs.TOTPIssuer, user.Email, secret),
+	})
+}
+
+// handleConfirmTOTP turns on the authenticator app once the user proves it
+// works, and hands out the recovery codes. They are only shown this once.
+func (h *Handler) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	var payload struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	totp, err := h.store.GetTOTPSecret(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if totp == nil || totp.ConfirmedAt != nil {
+		utils.WriteError(w, http.StatusBadRequest, errors.New("no pending authenticator app, enroll first"))
+		return
+	}
+
+	step, ok := utils.ValidateTOTP(totp.Secret, payload.Code, time.Now())
+	if !ok {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid code"))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.ConfirmTOTPSecret(userID, step, hashes); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":        "Authenticator app enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// handleDisableTOTP turns the authenticator app off, logins go back to
+// email codes.
+func (h *Handler) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.reauthenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.DisableTOTP(user.ID); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	go func() {
+		body := "The authenticator app was removed from your Serra account, login codes are sent by email again.\n\nIf it wasn't you, reset your password and contact support."
+		if err := h.mailer.Send(user.Email, "Your Serra authenticator app was removed", body); err != nil {
+			log.Println("disable TOTP: failed to send mail:", err)
+		}
+	}()
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Authenticator app disabled",
+	})
+}
+
+// handleRegenerateRecoveryCodes replaces all recovery codes, used or not.
+func (h *Handler) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.reauthenticate(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, map[string]any{
-		"message": "Account succesfully created!",
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":        "Recovery codes replaced",
+		"recovery_codes": codes,
 	})
 }
 
-func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+// reauthenticate checks the current_password in the request body against
+// the caller's account.
+func (h *Handler) reauthenticate(w http.ResponseWriter, r *http.Request) (*types.User, bool) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
 	var payload struct {
-		Email    string `json:"email" validate:"required,email"`
-		Password string `json:"password" validate:"required,min=6,max=20"`
+		CurrentPassword string `json:"current_password" validate:"required"`
 	}
 	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
-		return
+		return nil, false
 	}
 
 	if err := utils.Validate.Struct(payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
-		return
+		return nil, false
 	}
 
-	user, err := h.store.GetUserByEmail(payload.Email)
+	user, err := h.store.GetUserByID(userID)
 	if err != nil {
-		utils.WriteError(w, http.StatusUnauthorized, err)
-		return
+		utils.WriteError(w, http.StatusNotFound, err)
+		return nil, false
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(payload.CurrentPassword)); err != nil {
 		utils.WriteError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
+		return nil, false
+	}
+
+	return user, true
+}
+
+// newRecoveryCodes generates a set of recovery codes and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := utils.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i], err = utils.HashRecoveryCode(c)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return codes, hashes, nil
+}
+
+// webauthnTimeout is how long a passkey ceremony may take.
+const webauthnTimeout = 5 * time.Minute
+
+// webauthnCredentialJSON is a PublicKeyCredential as serialized by the
+// browser's toJSON(). Registration and login responses use different fields.
+type webauthnCredentialJSON struct {
+	ID       string `json:"id" validate:"required"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type" validate:"eq=public-key"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" validate:"required"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+func (h *Handler) handleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	credentials, err := h.store.GetWebAuthnCredentials(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	code := fmt.Sprintf("%06d", rand.IntN(1000000))
-	otpToken, err := utils.GenerateOTPToken(payload.Email, code, 5*time.Minute)
+	challenge, err := h.createWebAuthnChallenge(userID, types.WebAuthnRegistration)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	displayName := user.Username
+	if displayName == "" {
+		displayName = user.Email
+	}
+
+	params := []map[string]any{}
+	for _, alg := range utils.SupportedCOSEAlgorithms {
+		params = append(params, map[string]any{"type": "public-key", "alg": alg})
+	}
+
 	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"message":   "Login successful!",
-		"otp":       code,
-		"otp_token": otpToken,
+		"challenge_id": challenge.ID,
+		"public_key": map[string]any{
+			"challenge": utils.EncodeBase64URL(challenge.Challenge),
+			"rp": map[string]any{
+				"id":   config.Envs.WebAuthnRPID,
+				"name": config.Envs.WebAuthnRPName,
+			},
+			"user": map[string]any{
+				"id":          utils.EncodeBase64URL(webauthnUserHandle(userID)),
+				"name":        user.Email,
+				"displayName": displayName,
+			},
+			"pubKeyCredParams":   params,
+			"timeout":            webauthnTimeout.Milliseconds(),
+			"attestation":        "none",
+			"excludeCredentials": webauthnDescriptors(credentials),
+			"authenticatorSelection": map[string]any{
+				"residentKey":      "preferred",
+				"userVerification": "required",
+			},
+		},
 	})
 }
 
-func (h *Handler) handleVerifyOTP(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(utils.UserIDKey).(int64)
+
 	var payload struct {
-		Email    string `json:"email" validate:"required,email"`
-		Code     string `json:"code" validate:"required,len=6"`
-		OTPToken string `json:"otp_token" validate:"required"`
+		ChallengeID string                 `json:"challenge_id" validate:"required"`
+		Name        string                 `json:"name" validate:"max=100"`
+		Credential  webauthnCredentialJSON `json:"credential"`
 	}
 	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
@@ -125,75 +1369,226 @@ func (h *Handler) handleVerifyOTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	emailFromToken, otpFromToken, err := utils.VerifyOTPToken(payload.OTPToken)
-	if err != nil {
-		utils.WriteError(w, http.StatusUnauthorized, err)
+	challenge, err := h.store.ConsumeWebAuthnChallenge(payload.ChallengeID, types.WebAuthnRegistration)
+	if err != nil || challenge.UserID != userID {
+		utils.WriteError(w, http.StatusBadRequest, errors.New("challenge expired or already used"))
 		return
 	}
 
-	if payload.Email != emailFromToken || payload.Code != otpFromToken {
-		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid OTP"))
+	clientData, err1 := utils.DecodeBase64URL(payload.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := utils.DecodeBase64URL(payload.Credential.Response.AttestationObject)
+	if err := errors.Join(err1, err2); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, errors.New("invalid credential encoding"))
 		return
 	}
 
-	user, err := h.store.GetUserByEmail(payload.Email)
+	attestation, err := utils.VerifyWebAuthnRegistration(webauthnCeremony(challenge), clientData, attestationObject)
 	if err != nil {
-		utils.WriteError(w, http.StatusUnauthorized, errors.New("user not found"))
+		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	token, err := utils.GenerateJWT(user.ID)
-	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+	name := payload.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	credential := &types.WebAuthnCredential{
+		UserID:       userID,
+		CredentialID: attestation.CredentialID,
+		PublicKey:    attestation.PublicKey,
+		SignCount:    attestation.SignCount,
+		Name:         name,
+	}
+	if err := h.store.AddWebAuthnCredential(credential); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken()
+	utils.WriteJSON(w, http.StatusCreated, credential)
+}
+
+// handleWebAuthnLoginBegin starts a passkey login. With an email the client
+// gets the account's credentials to pick from, without one the authenticator
+// offers its discoverable credentials.
+func (h *Handler) handleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email" validate:"omitempty,email"`
+	}
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var userID int64
+	credentials := []types.WebAuthnCredential{}
+	if payload.Email != "" {
+		// Unknown emails get an empty list rather than an error, so this
+		// endpoint can't be used to find out who has an account.
+		if user, err := h.store.GetUserByEmail(payload.Email); err == nil {
+			userID = user.ID
+			credentials, err = h.store.GetWebAuthnCredentials(user.ID)
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	challenge, err := h.createWebAuthnChallenge(userID, types.WebAuthnLogin)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
-	h.store.SaveRefreshToken(user.ID, refreshToken, time.Now().Add(7*24*time.Hour))
 
 	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"message":       "OTP verified successfully",
-		"token":         token,
-		"refresh_token": refreshToken,
+		"challenge_id": challenge.ID,
+		"public_key": map[string]any{
+			"challenge":        utils.EncodeBase64URL(challenge.Challenge),
+			"rpId":             config.Envs.WebAuthnRPID,
+			"timeout":          webauthnTimeout.Milliseconds(),
+			"allowCredentials": webauthnDescriptors(credentials),
+			"userVerification": "required",
+		},
 	})
 }
 
-func (h *Handler) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		RefreshToken string `json:"refresh_token" validate:"required"`
+		ChallengeID string                 `json:"challenge_id" validate:"required"`
+		Credential  webauthnCredentialJSON `json:"credential"`
+		DeviceID    int64                  `json:"device_id"`
+		DeviceName  string                 `json:"device_name" validate:"max=100"`
 	}
 	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	userID, err := h.store.GetRefreshToken(payload.RefreshToken)
+	if err := utils.Validate.Struct(payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	challenge, err := h.store.ConsumeWebAuthnChallenge(payload.ChallengeID, types.WebAuthnLogin)
 	if err != nil {
 		utils.WriteError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	token, err := utils.GenerateJWT(userID)
+	response := payload.Credential.Response
+	credentialID, err1 := utils.DecodeBase64URL(payload.Credential.ID)
+	clientData, err2 := utils.DecodeBase64URL(response.ClientDataJSON)
+	authData, err3 := utils.DecodeBase64URL(response.AuthenticatorData)
+	signature, err4 := utils.DecodeBase64URL(response.Signature)
+	userHandle, err5 := utils.DecodeBase64URL(response.UserHandle)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, errors.New("invalid credential encoding"))
+		return
+	}
+
+	credential, err := h.store.GetWebAuthnCredential(credentialID)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"token": token,
-	})
+	// The credential has to belong to the account the login was started for,
+	// and to the user the authenticator says it is for.
+	if (challenge.UserID != 0 && challenge.UserID != credential.UserID) ||
+		(len(userHandle) > 0 && string(userHandle) != string(webauthnUserHandle(credential.UserID))) {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("unknown passkey"))
+		return
+	}
+
+	signCount, err := utils.VerifyWebAuthnAssertion(webauthnCeremony(challenge), credential.PublicKey, credential.SignCount, clientData, authData, signature)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err := h.store.UpdateWebAuthnSignCount(credential.ID, credential.SignCount, signCount); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	user, err := h.store.GetUserByID(credential.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("user not found"))
+		return
+	}
+
+	h.issueSession(w, r, user, payload.DeviceID, payload.DeviceName, "Passkey verified successfully")
 }
 
-func (h *Handler) handleOnboarding(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) createWebAuthnChallenge(userID int64, ceremony string) (*types.WebAuthnChallenge, error) {
+	id, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := utils.GenerateWebAuthnChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &types.WebAuthnChallenge{
+		ID:        id,
+		UserID:    userID,
+		Ceremony:  ceremony,
+		Challenge: value,
+		ExpiresAt: time.Now().Add(webauthnTimeout),
+	}
+
+	return challenge, h.store.CreateWebAuthnChallenge(challenge)
+}
+
+func webauthnCeremony(challenge *types.WebAuthnChallenge) utils.WebAuthnCeremony {
+	return utils.WebAuthnCeremony{
+		RPID:             config.Envs.WebAuthnRPID,
+		Origins:          config.Envs.WebAuthnOrigins,
+		Challenge:        challenge.Challenge,
+		UserVerification: true,
+	}
+}
+
+// webauthnUserHandle is the user.id passkeys are created with.
+func webauthnUserHandle(userID int64) []byte {
+	return []byte(strconv.FormatInt(userID, 10))
+}
+
+func webauthnDescriptors(credentials []types.WebAuthnCredential) []map[string]any {
+	descriptors := []map[string]any{}
+	for _, c := range credentials {
+		descriptors = append(descriptors, map[string]any{
+			"type": "public-key",
+			"id":   utils.EncodeBase64URL(c.CredentialID),
+		})
+	}
+
+	return descriptors
+}
+
+func (h *Handler) handleUploadKeys(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(utils.UserIDKey).(int64)
+	deviceID, ok := deviceFromContext(w, r)
+	if !ok {
+		return
+	}
 
+	// The bundle fields go together. Leaving them out appends one-time
+	// prekeys to the existing bundle without touching the rest.
 	var payload struct {
-		Username   string `json:"username" validate:"required,min=3"`
-		ProfilePic string `json:"profile_pic"`
+		IdentityKey           string                `json:"identity_key" validate:"required_with=SignedPrekey SignedPrekeySignature"`
+		SignedPrekeyID        uint32                `json:"signed_prekey_id" validate:"required_with=IdentityKey"`
+		SignedPrekey          string                `json:"signed_prekey" validate:"required_with=IdentityKey SignedPrekeySignature"`
+		SignedPrekeySignature string                `json:"signed_prekey_signature" validate:"required_with=IdentityKey SignedPrekey"`
+		OneTimePrekeys        []types.OneTimePrekey `json:"one_time_prekeys" validate:"max=100,dive"`
 	}
 	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
@@ -205,45 +1600,120 @@ func (h *Handler) handleOnboarding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if payload.ProfilePic == "" {
-		payload.ProfilePic = "https://i.pinimg.com/736x/f9/24/12/f924127a8033eecbb67b0e1509097095.jpg"
-	}
+	var (
+		err             error
+		identityChanged bool
+	)
+	switch {
+	case payload.IdentityKey != "":
+		if err := utils.VerifySignedPrekey(payload.IdentityKey, payload.SignedPrekey, payload.SignedPrekeySignature); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
 
-	err := h.store.SetUserProfile(userID, payload.Username, payload.ProfilePic)
+		signedPrekey := types.SignedPrekey{
+			KeyID:     payload.SignedPrekeyID,
+			PublicKey: payload.SignedPrekey,
+			Signature: payload.SignedPrekeySignature,
+		}
+		identityChanged, err = h.store.UpsertPrekeyBundle(userID, deviceID, payload.IdentityKey, signedPrekey, payload.OneTimePrekeys)
+	case len(payload.OneTimePrekeys) > 0:
+		err = h.store.AddOneTimePrekeys(userID, deviceID, payload.OneTimePrekeys)
+	default:
+		utils.WriteError(w, http.StatusBadRequest, errors.New("nothing to upload"))
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	if identityChanged {
+		h.announceIdentityChange(userID, deviceID, payload.IdentityKey)
+	}
+
+	count, err := h.store.CountOneTimePrekeys(deviceID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if count >= config.Envs.PrekeyLowWatermark {
+		if err := h.store.SetReplenishKeys(deviceID, false); err != nil {
+			log.Println("keys: failed to clear the replenish flag:", err)
+		}
+	}
+
 	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"message": "Profile updated!",
+		"message": "Keys uploaded succesfully",
+		"count":   count,
 	})
 }
 
-func (h *Handler) handleProfile(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(utils.UserIDKey).(int64)
+// announceIdentityChange tells everyone the user talks to, and the user's
+// other devices, that a device now uses a different identity key so clients
+// can show a safety number warning.
+func (h *Handler) announceIdentityChange(userID, deviceID int64, identityKey string) {
+	fingerprint, err := utils.IdentityFingerprint(userID, identityKey)
+	if err != nil {
+		log.Println("keys: failed to compute identity fingerprint:", err)
+		return
+	}
 
-	user, err := h.store.GetUserByID(userID)
+	event := types.Event{Type: "identity_changed", Data: map[string]any{
+		"user_id":     userID,
+		"device_id":   deviceID,
+		"fingerprint": fingerprint,
+	}}
+	h.notifier.NotifyPartners(userID, event)
+	h.notifier.NotifyUsers([]int64{userID}, event)
+}
+
+func (h *Handler) handleGetIdentityKeys(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userIDStr := vars["user_id"]
+
+	userID, err := strconv.ParseInt(userIDStr, 10, 64)
 	if err != nil {
-		utils.WriteError(w, http.StatusNotFound, err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	keys, err := h.store.GetIdentityKeys(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if len(keys) == 0 {
+		utils.WriteError(w, http.StatusNotFound, errors.New("prekey bundle not found"))
+		return
+	}
+
+	for i := range keys {
+		keys[i].Fingerprint, err = utils.IdentityFingerprint(userID, keys[i].IdentityKey)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"id":       user.ID,
-		"email":    user.Email,
-		"username": user.Username,
+		"user_id": userID,
+		"devices": keys,
 	})
 }
 
-func (h *Handler) handleUploadKeys(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(utils.UserIDKey).(int64)
+func (h *Handler) handleRotateSignedPrekey(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := deviceFromContext(w, r)
+	if !ok {
+		return
+	}
 
 	var payload struct {
-		IdentityKey           string   `json:"identity_key" validate:"required"`
-		SignedPrekey          string   `json:"signed_prekey" validate:"required"`
-		SignedPrekeySignature string   `json:"signed_prekey_signature" validate:"required"`
-		OneTimePrekeys        []string `json:"one_time_prekeys" validate:"required,dive,required"`
+		SignedPrekeyID        uint32 `json:"signed_prekey_id" validate:"required"`
+		SignedPrekey          string `json:"signed_prekey" validate:"required"`
+		SignedPrekeySignature string `json:"signed_prekey_signature" validate:"required"`
 	}
 	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
@@ -255,14 +1725,71 @@ func (h *Handler) handleUploadKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.store.UpsertPrekeyBundle(userID, payload.IdentityKey, payload.SignedPrekey, payload.SignedPrekeySignature, payload.OneTimePrekeys)
+	identityKey, err := h.store.GetIdentityKey(deviceID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.VerifySignedPrekey(identityKey, payload.SignedPrekey, payload.SignedPrekeySignature); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	signedPrekey := types.SignedPrekey{
+		KeyID:     payload.SignedPrekeyID,
+		PublicKey: payload.SignedPrekey,
+		Signature: payload.SignedPrekeySignature,
+	}
+	if err := h.store.RotateSignedPrekey(deviceID, signedPrekey); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Previous keys are only needed for the grace period, drop anything older.
+	if err := h.store.PurgeSignedPrekeyHistory(deviceID, time.Now().Add(-config.Envs.SignedPrekeyGracePeriod)); err != nil {
+		log.Println("keys: failed to purge signed prekey history:", err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message": "Signed prekey rotated",
+	})
+}
+
+func (h *Handler) handleGetSignedPrekeys(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := deviceFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := h.store.GetSignedPrekeys(deviceID, time.Now().Add(-config.Envs.SignedPrekeyGracePeriod))
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"signed_prekeys": keys,
+		"grace_period":   config.Envs.SignedPrekeyGracePeriod.String(),
+	})
+}
+
+func (h *Handler) handleCountKeys(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := deviceFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := h.store.CountOneTimePrekeys(deviceID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, map[string]any{
-		"message": "Keys uploaded succesfully",
+		"count":         count,
+		"low_watermark": config.Envs.PrekeyLowWatermark,
+		"replenish":     count < config.Envs.PrekeyLowWatermark,
 	})
 }
 
@@ -276,11 +1803,54 @@ func (h *Handler) handleGetPrekeyBundle(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	bundle, err := h.store.GetPrekeyBundle(userID)
+	bundles, err := h.store.GetPrekeyBundles(userID)
 	if err != nil {
 		utils.WriteError(w, http.StatusNotFound, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, bundle)
+	for _, bundle := range bundles {
+		h.checkPrekeyWatermark(userID, bundle["device_id"].(int64))
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"user_id": userID,
+		"devices": bundles,
+	})
+}
+
+// checkPrekeyWatermark asks the device to upload more one-time prekeys once
+// its pool drops below the configured low watermark. The request is also
+// remembered, a device that is offline now gets it when it connects.
+func (h *Handler) checkPrekeyWatermark(userID, deviceID int64) {
+	count, err := h.store.CountOneTimePrekeys(deviceID)
+	if err != nil {
+		log.Println("keys: failed to count one-time prekeys:", err)
+		return
+	}
+
+	if count >= config.Envs.PrekeyLowWatermark {
+		return
+	}
+
+	if err := h.store.SetReplenishKeys(deviceID, true); err != nil {
+		log.Println("keys: failed to set the replenish flag:", err)
+	}
+
+	h.notifier.NotifyDevice(userID, deviceID, types.Event{Type: "replenish_keys", Data: map[string]any{
+		"count":         count,
+		"low_watermark": config.Envs.PrekeyLowWatermark,
+	}})
+}
+
+// deviceFromContext returns the device the access token was issued to. Keys
+// belong to a device, so tokens from before devices existed are turned away.
+func deviceFromContext(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	deviceID := r.Context().Value(utils.DeviceIDKey).(int64)
+	if deviceID == 0 {
+		utils.WriteError(w, http.StatusUnauthorized, errors.New("token is not bound to a device, refresh it or log in again"))
+		return 0, false
+	}
+
+	return deviceID, true
 }
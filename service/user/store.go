@@ -2,10 +2,13 @@ package user
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"serra/types"
+	"serra/utils"
+	"strings"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 type Store struct {
@@ -38,91 +41,385 @@ func (s *Store) CreateUser(u *types.User) error {
 
 func (s *Store) GetUserByEmail(email string) (*types.User, error) {
 	var u types.User
-	err := s.db.QueryRow(`SELECT id, username, email, password FROM users WHERE email = ?`, email).Scan(&u.ID, &u.Username, &u.ProfilePic, &u.Email, &u.Password)
+	var verifiedAt, deleteAfter sql.NullTime
+	err := s.db.QueryRow(`SELECT id, COALESCE(username, ''), COALESCE(profile_pic, ''), email, email_verified_at, delete_after, password FROM users WHERE email = ?`, email).
+		Scan(&u.ID, &u.Username, &u.ProfilePic, &u.Email, &verifiedAt, &deleteAfter, &u.Password)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("user not found")
 		}
 		return nil, err
 	}
+	if verifiedAt.Valid {
+		u.EmailVerifiedAt = &verifiedAt.Time
+	}
+	if deleteAfter.Valid {
+		u.DeleteAfter = &deleteAfter.Time
+	}
 
 	return &u, nil
 }
 
 func (s *Store) GetUserByID(id int64) (*types.User, error) {
 	var u types.User
-	err := s.db.QueryRow(`SELECT id, username, email, password FROM users WHERE id = ?`, id).
-		Scan(&u.ID, &u.Username, &u.ProfilePic, &u.Email, &u.Password)
+	var verifiedAt, deleteAfter sql.NullTime
+	err := s.db.QueryRow(`SELECT id, COALESCE(username, ''), COALESCE(profile_pic, ''), email, email_verified_at, delete_after, password FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.Username, &u.ProfilePic, &u.Email, &verifiedAt, &deleteAfter, &u.Password)
 	if err != nil {
 		return nil, err
 	}
+	if verifiedAt.Valid {
+		u.EmailVerifiedAt = &verifiedAt.Time
+	}
+	if deleteAfter.Valid {
+		u.DeleteAfter = &deleteAfter.Time
+	}
 
 	return &u, nil
 }
 
-func (s *Store) UpsertPrekeyBundle(userID int64, identityKey, signedPrekey, signature string, oneTimePrekeys []string) error {
-	prekeysJSON, err := json.Marshal(oneTimePrekeys)
+func (s *Store) CreateDevice(userID int64, name string) (*types.Device, error) {
+	res, err := s.db.Exec(`INSERT INTO devices (user_id, name) VALUES (?, ?)`, userID, name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	id, _ := res.LastInsertId()
+	return s.GetDevice(userID, id)
+}
+
+func (s *Store) GetDevice(userID, deviceID int64) (*types.Device, error) {
+	var d types.Device
+	err := s.db.QueryRow(`SELECT id, user_id, name, created_at FROM devices WHERE id = ? AND user_id = ?`, deviceID, userID).
+		Scan(&d.ID, &d.UserID, &d.Name, &d.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("device not found")
+		}
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// UpsertPrekeyBundle stores the device's bundle and reports whether it
+// replaced a different identity key.
+func (s *Store) UpsertPrekeyBundle(userID, deviceID int64, identityKey string, signedPrekey types.SignedPrekey, oneTimePrekeys []types.OneTimePrekey) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var currentIdentityKey string
+	err = tx.QueryRow(`SELECT identity_key FROM prekeys WHERE device_id = ? FOR UPDATE`, deviceID).Scan(&currentIdentityKey)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	firstUpload := err == sql.ErrNoRows
+	identityChanged := !firstUpload && currentIdentityKey != identityKey
+
+	if firstUpload || identityChanged {
+		_, err := tx.Exec(`INSERT INTO identity_key_history (user_id, device_id, identity_key) VALUES (?, ?, ?)`, userID, deviceID, identityKey)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if identityChanged {
+		// One-time prekeys made with the old identity can't be used anymore.
+		if _, err := tx.Exec(`DELETE FROM one_time_prekeys WHERE device_id = ?`, deviceID); err != nil {
+			return false, err
+		}
 	}
 
-	_, err = s.db.Exec(`INSERT INTO prekeys (user_id, identity_key, signed_prekey, signed_prekey_signature, one_time_prekeys)
-	VALUES (?, ?, ?, ?, ?)
+	if err := archiveSignedPrekey(tx, deviceID, signedPrekey.KeyID); err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO prekeys (user_id, device_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature)
+	VALUES (?, ?, ?, ?, ?, ?)
 	ON DUPLICATE KEY UPDATE
 	identity_key = VALUES(identity_key),
+	signed_prekey_id = VALUES(signed_prekey_id),
 	signed_prekey = VALUES(signed_prekey),
-	signed_prekey_signature = VALUES(signed_prekey_signature),
-	one_time_prekeys = VALUES(one_time_prekeys)`, userID, identityKey, signedPrekey, signature, prekeysJSON)
+	signed_prekey_signature = VALUES(signed_prekey_signature)`, userID, deviceID, identityKey, signedPrekey.KeyID, signedPrekey.PublicKey, signedPrekey.Signature)
+	if err != nil {
+		return false, err
+	}
 
+	if err := insertOneTimePrekeys(tx, userID, deviceID, oneTimePrekeys); err != nil {
+		return false, err
+	}
+
+	return identityChanged, tx.Commit()
+}
+
+func (s *Store) AddOneTimePrekeys(userID, deviceID int64, oneTimePrekeys []types.OneTimePrekey) error {
+	var exists int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM prekeys WHERE device_id = ?`, deviceID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists == 0 {
+		return errors.New("upload a full key bundle first")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertOneTimePrekeys(tx, userID, deviceID, oneTimePrekeys); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) CountOneTimePrekeys(deviceID int64) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM one_time_prekeys WHERE device_id = ?`, deviceID).Scan(&count)
+	return count, err
+}
+
+// SetReplenishKeys records whether the device still has to top up its
+// one-time prekeys.
+func (s *Store) SetReplenishKeys(deviceID int64, pending bool) error {
+	_, err := s.db.Exec(`UPDATE devices SET replenish_keys = ? WHERE id = ?`, pending, deviceID)
 	return err
 }
 
-func (s *Store) GetPrekeyBundle(userID int64) (map[string]any, error) {
-	var (
-		identityKey  string
-		signedPrekey string
-		signature    string
-		prekeysJSON  string
-	)
+func (s *Store) GetIdentityKey(deviceID int64) (string, error) {
+	var identityKey string
+	err := s.db.QueryRow(`SELECT identity_key FROM prekeys WHERE device_id = ?`, deviceID).Scan(&identityKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errors.New("upload a full key bundle first")
+		}
+		return "", err
+	}
+
+	return identityKey, nil
+}
+
+func (s *Store) GetIdentityKeys(userID int64) ([]types.IdentityKey, error) {
+	// The newest history row of a device is the key it uses now.
+	rows, err := s.db.Query(`SELECT p.device_id, p.identity_key,
+	COALESCE((SELECT MAX(h.created_at) FROM identity_key_history h WHERE h.device_id = p.device_id), p.updated_at)
+	FROM prekeys p
+	WHERE p.user_id = ?
+	ORDER BY p.device_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []types.IdentityKey{}
+	for rows.Next() {
+		var k types.IdentityKey
+		if err := rows.Scan(&k.DeviceID, &k.IdentityKey, &k.Since); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// insertOneTimePrekeys appends keys to the device's pool, existing keys are kept.
+func insertOneTimePrekeys(tx *sql.Tx, userID, deviceID int64, oneTimePrekeys []types.OneTimePrekey) error {
+	if len(oneTimePrekeys) == 0 {
+		return nil
+	}
+
+	args := make([]any, 0, len(oneTimePrekeys)*4)
+	for _, prekey := range oneTimePrekeys {
+		args = append(args, userID, deviceID, prekey.KeyID, prekey.PublicKey)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", len(oneTimePrekeys)), ",")
+
+	_, err := tx.Exec(`INSERT INTO one_time_prekeys (user_id, device_id, key_id, prekey) VALUES `+placeholders, args...)
+	if isDuplicateEntry(err) {
+		return errors.New("one-time prekey id already in use")
+	}
+
+	return err
+}
 
-	err := s.db.QueryRow(`SELECT identity_key, signed_prekey, signed_prekey_signature, one_time_prekeys
+// archiveSignedPrekey copies the current signed prekey into the history
+// before it is replaced by a key with a different ID.
+func archiveSignedPrekey(tx *sql.Tx, deviceID int64, newKeyID uint32) error {
+	_, err := tx.Exec(`INSERT INTO signed_prekey_history (user_id, device_id, key_id, signed_prekey, signed_prekey_signature)
+	SELECT user_id, device_id, signed_prekey_id, signed_prekey, signed_prekey_signature
 	FROM prekeys
-	WHERE user_id = ?`, userID).Scan(&identityKey, &signedPrekey, &signature, &prekeysJSON)
+	WHERE device_id = ? AND signed_prekey_id != ?`, deviceID, newKeyID)
+	return err
+}
+
+// GetPrekeyBundles returns one bundle per device of the user, each with a
+// freshly claimed one-time prekey when the device still has one.
+func (s *Store) GetPrekeyBundles(userID int64) ([]map[string]any, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT device_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature
+	FROM prekeys
+	WHERE user_id = ?
+	ORDER BY device_id`, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Decode json array
-	var prekeys []string
-	if err := json.Unmarshal([]byte(prekeysJSON), &prekeys); err != nil {
+	bundles := []map[string]any{}
+	for rows.Next() {
+		var (
+			deviceID       int64
+			identityKey    string
+			signedPrekeyID uint32
+			signedPrekey   string
+			signature      string
+		)
+		if err := rows.Scan(&deviceID, &identityKey, &signedPrekeyID, &signedPrekey, &signature); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		bundles = append(bundles, map[string]any{
+			"device_id":               deviceID,
+			"identity_key":            identityKey,
+			"signed_prekey_id":        signedPrekeyID,
+			"signed_prekey":           signedPrekey,
+			"signed_prekey_signature": signature,
+			"one_time_prekey_id":      nil,
+			"one_time_prekey":         nil,
+			"has_one_time_prekey":     false,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(bundles) == 0 {
+		return nil, errors.New("prekey bundle not found")
+	}
+
+	for _, bundle := range bundles {
+		var (
+			prekeyRowID int64
+			prekeyID    uint32
+			prekey      string
+		)
+
+		// Lock the oldest unclaimed key so concurrent fetches each get a different one.
+		err := tx.QueryRow(`SELECT id, key_id, prekey
+		FROM one_time_prekeys
+		WHERE device_id = ?
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`, bundle["device_id"]).Scan(&prekeyRowID, &prekeyID, &prekey)
+		if err == sql.ErrNoRows {
+			// Pool is empty, the sender falls back to the signed prekey only.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM one_time_prekeys WHERE id = ?`, prekeyRowID); err != nil {
+			return nil, err
+		}
+
+		bundle["one_time_prekey_id"] = prekeyID
+		bundle["one_time_prekey"] = prekey
+		bundle["has_one_time_prekey"] = true
+	}
+
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	if len(prekeys) == 0 {
-		return nil, errors.New("no one-time prekeys available")
+	return bundles, nil
+}
+
+func (s *Store) RotateSignedPrekey(deviceID int64, signedPrekey types.SignedPrekey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentID uint32
+	err = tx.QueryRow(`SELECT signed_prekey_id FROM prekeys WHERE device_id = ? FOR UPDATE`, deviceID).Scan(&currentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("upload a full key bundle first")
+		}
+		return err
+	}
+
+	if currentID == signedPrekey.KeyID {
+		return errors.New("signed prekey id already in use")
+	}
+
+	if err := archiveSignedPrekey(tx, deviceID, signedPrekey.KeyID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE prekeys SET signed_prekey_id = ?, signed_prekey = ?, signed_prekey_signature = ? WHERE device_id = ?`,
+		signedPrekey.KeyID, signedPrekey.PublicKey, signedPrekey.Signature, deviceID)
+	if err != nil {
+		return err
 	}
 
-	// Pop one prekeys
-	oneTimePrekey := prekeys[0]
-	remaining := prekeys[1:]
+	return tx.Commit()
+}
 
-	// Update, remaining list in db
-	updated, err := json.Marshal(remaining)
+func (s *Store) GetSignedPrekeys(deviceID int64, replacedAfter time.Time) ([]types.SignedPrekey, error) {
+	var current types.SignedPrekey
+	err := s.db.QueryRow(`SELECT signed_prekey_id, signed_prekey, signed_prekey_signature FROM prekeys WHERE device_id = ?`, deviceID).
+		Scan(&current.KeyID, &current.PublicKey, &current.Signature)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("prekey bundle not found")
+		}
 		return nil, err
 	}
 
-	_, err = s.db.Exec(`UPDATE prekeys SET one_time_prekeys = ? WHERE user_id = ?`, updated, userID)
+	rows, err := s.db.Query(`SELECT key_id, signed_prekey, signed_prekey_signature, replaced_at
+	FROM signed_prekey_history
+	WHERE device_id = ? AND replaced_at > ?
+	ORDER BY replaced_at DESC`, deviceID, replacedAfter)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	keys := []types.SignedPrekey{current}
+	for rows.Next() {
+		var (
+			k          types.SignedPrekey
+			replacedAt time.Time
+		)
+		if err := rows.Scan(&k.KeyID, &k.PublicKey, &k.Signature, &replacedAt); err != nil {
+			return nil, err
+		}
+		k.ReplacedAt = &replacedAt
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
 
-	return map[string]any{
-		"identity_key":            identityKey,
-		"signed_prekey":           signedPrekey,
-		"signed_prekey_signature": signature,
-		"ne_time_prekey":          oneTimePrekey,
-	}, nil
+func (s *Store) PurgeSignedPrekeyHistory(deviceID int64, replacedBefore time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM signed_prekey_history WHERE device_id = ? AND replaced_at <= ?`, deviceID, replacedBefore)
+	return err
 }
 
 func (s *Store) SetUserProfile(userID int64, username, profilePic string) error {
@@ -140,22 +437,826 @@ func (s *Store) SetUserProfile(userID int64, username, profilePic string) error
 	return err
 }
 
-func (s *Store) SaveRefreshToken(userID int64, token string, expires time.Time) error {
-	_, err := s.db.Exec(`INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`, token, userID, expires)
+// CreateUserToken stores a token sent by email. Earlier unused tokens for the
+// same purpose stop working, only the latest email counts.
+func (s *Store) CreateUserToken(t *types.UserToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL`, t.UserID, t.Purpose); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO user_tokens (token_hash, user_id, purpose, data, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		t.TokenHash, t.UserID, t.Purpose, t.Data, t.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseUserToken spends a token and returns it.
+func (s *Store) UseUserToken(purpose, tokenHash string) (*types.UserToken, error) {
+	res, err := s.db.Exec(`UPDATE user_tokens SET used_at = ?
+	WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`, time.Now(), tokenHash, purpose, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	t := types.UserToken{TokenHash: tokenHash}
+	err = s.db.QueryRow(`SELECT user_id, purpose, data, expires_at FROM user_tokens WHERE token_hash = ?`, tokenHash).
+		Scan(&t.UserID, &t.Purpose, &t.Data, &t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (s *Store) MarkEmailVerified(userID int64) error {
+	_, err := s.db.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?`, time.Now(), userID)
 	return err
 }
 
-func (s *Store) GetRefreshToken(token string) (int64, error) {
-	var userID int64
-	var expiresAt time.Time
-	err := s.db.QueryRow(`SELECT user_id, expires_at FROM refresh_tokens WHERE token = ?`, token).Scan(&userID, &expiresAt)
+// UpdateEmail switches the account to a new, already confirmed address.
+// Password reset and verification links sent to the old address stop
+// working.
+func (s *Store) UpdateEmail(userID int64, email string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET email = ?, email_verified_at = ? WHERE id = ?`, email, time.Now(), userID)
+	if isDuplicateEntry(err) {
+		return errors.New("email already registered")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_tokens WHERE user_id = ? AND purpose IN (?, ?) AND used_at IS NULL`,
+		userID, types.TokenPurposePasswordReset, types.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePassword sets a new password hash and revokes every session, so a
+// leaked password or refresh token stops working. Pending email changes and
+// password resets go too, whoever started them may not know the new password.
+func (s *Store) UpdatePassword(userID int64, passwordHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, passwordHash, userID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_tokens WHERE user_id = ? AND purpose IN (?, ?) AND used_at IS NULL`,
+		userID, types.TokenPurposeChangeEmail, types.TokenPurposePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteUnverifiedUsers removes accounts that never verified their email.
+func (s *Store) DeleteUnverifiedUsers(createdBefore time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM users WHERE email_verified_at IS NULL AND created_at < ?`, createdBefore)
 	if err != nil {
 		return 0, err
 	}
 
-	if time.Now().After(expiresAt) {
-		return 0, errors.New("refresh token expired")
+	return res.RowsAffected()
+}
+
+func (s *Store) DeleteExpiredUserTokens() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM user_tokens WHERE expires_at < ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// ScheduleUserDeletion marks the account to be purged after deleteAfter.
+func (s *Store) ScheduleUserDeletion(userID int64, deleteAfter time.Time) error {
+	_, err := s.db.Exec(`UPDATE users SET delete_after = ? WHERE id = ?`, deleteAfter, userID)
+	return err
+}
+
+func (s *Store) CancelUserDeletion(userID int64) error {
+	res, err := s.db.Exec(`UPDATE users SET delete_after = NULL WHERE id = ? AND delete_after IS NOT NULL`, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("account is not scheduled for deletion")
+	}
+
+	return nil
+}
+
+// GetUsersDueForDeletion returns the accounts whose grace period is over.
+func (s *Store) GetUsersDueForDeletion(now time.Time) ([]int64, error) {
+	rows, err := s.db.Query(`SELECT id FROM users WHERE delete_after IS NOT NULL AND delete_after <= ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
 
-	return userID, nil
+	return ids, rows.Err()
+}
+
+// DeleteUser removes the account and returns everyone it had exchanged
+// messages with, the list goes with the account. Refresh tokens and queued
+// messages are deleted explicitly, everything else goes with the users row.
+func (s *Store) DeleteUser(userID int64) ([]int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT partner_id FROM conversation_partners WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	partners := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		partners = append(partners, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE recipient_id = ? OR sender_id = ?`, userID, userID); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if affected == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	return partners, tx.Commit()
+}
+
+func (s *Store) CreateOTPChallenge(c *types.OTPChallenge) error {
+	_, err := s.db.Exec(`INSERT INTO otp_challenges (id, user_id, method, purpose, code_hash, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		c.ID, c.UserID, c.Method, c.Purpose, c.CodeHash, c.ExpiresAt)
+	return err
+}
+
+// RecordOTPAttempt counts a verification attempt before the code is checked,
+// so parallel guesses can't get past the limit. It fails once the challenge
+// is used, expired or locked.
+func (s *Store) RecordOTPAttempt(id string, maxAttempts int) (*types.OTPChallenge, error) {
+	res, err := s.db.Exec(`UPDATE otp_challenges SET attempts = attempts + 1
+	WHERE id = ? AND consumed_at IS NULL AND expires_at > ? AND attempts < ?`, id, time.Now(), maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	var c types.OTPChallenge
+	var consumedAt sql.NullTime
+	err = s.db.QueryRow(`SELECT id, user_id, method, purpose, code_hash, attempts, expires_at, consumed_at FROM otp_challenges WHERE id = ?`, id).
+		Scan(&c.ID, &c.UserID, &c.Method, &c.Purpose, &c.CodeHash, &c.Attempts, &c.ExpiresAt, &consumedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("invalid OTP")
+		}
+		return nil, err
+	}
+
+	if affected == 0 {
+		switch {
+		case consumedAt.Valid:
+			return nil, errors.New("OTP already used")
+		case time.Now().After(c.ExpiresAt):
+			return nil, errors.New("OTP expired")
+		default:
+			return nil, errors.New("too many attempts, log in again")
+		}
+	}
+
+	return &c, nil
+}
+
+func (s *Store) ConsumeOTPChallenge(id string) error {
+	res, err := s.db.Exec(`UPDATE otp_challenges SET consumed_at = ? WHERE id = ? AND consumed_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("OTP already used")
+	}
+
+	return nil
+}
+
+// DeleteExpiredOTPChallenges removes challenges that can no longer be
+// answered, because they expired or were used.
+func (s *Store) DeleteExpiredOTPChallenges() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM otp_challenges WHERE expires_at < ? OR consumed_at IS NOT NULL`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// GetTOTPSecret returns the user's TOTP secret, or nil when there is none.
+func (s *Store) GetTOTPSecret(userID int64) (*types.TOTPSecret, error) {
+	t := types.TOTPSecret{UserID: userID}
+	var confirmedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT secret, confirmed_at, last_used_step FROM totp_secrets WHERE user_id = ?`, userID).
+		Scan(&t.Secret, &confirmedAt, &t.LastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		t.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return &t, nil
+}
+
+// SaveTOTPSecret stores a new, unconfirmed secret. Enrolling again before
+// confirming replaces the pending secret, a confirmed one is kept.
+func (s *Store) SaveTOTPSecret(userID int64, secret string) error {
+	res, err := s.db.Exec(`INSERT INTO totp_secrets (user_id, secret) VALUES (?, ?)
+	ON DUPLICATE KEY UPDATE secret = IF(confirmed_at IS NULL, VALUES(secret), secret), last_used_step = IF(confirmed_at IS NULL, 0, last_used_step)`,
+		userID, secret)
+	if err != nil {
+		return err
+	}
+
+	// MySQL reports 0 affected rows when the duplicate row is left unchanged.
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("authenticator app already enabled")
+	}
+
+	return nil
+}
+
+// ConfirmTOTPSecret activates the pending secret and replaces the user's
+// recovery codes.
+func (s *Store) ConfirmTOTPSecret(userID, step int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE totp_secrets SET confirmed_at = ?, last_used_step = ?
+	WHERE user_id = ? AND confirmed_at IS NULL`, time.Now(), step, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("no pending authenticator app")
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP removes the user's authenticator app, pending or confirmed,
+// together with the recovery codes.
+func (s *Store) DisableTOTP(userID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM totp_secrets WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("authenticator app not enabled")
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes swaps the recovery codes of a user whose
+// authenticator app is enabled for new ones.
+func (s *Store) ReplaceRecoveryCodes(userID int64, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var confirmed bool
+	err = tx.QueryRow(`SELECT confirmed_at IS NOT NULL FROM totp_secrets WHERE user_id = ? FOR UPDATE`, userID).Scan(&confirmed)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !confirmed {
+		return errors.New("authenticator app not enabled")
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64, recoveryCodeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	if len(recoveryCodeHashes) == 0 {
+		return nil
+	}
+
+	args := make([]any, 0, len(recoveryCodeHashes)*2)
+	for _, h := range recoveryCodeHashes {
+		args = append(args, userID, h)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("(?, ?),", len(recoveryCodeHashes)), ",")
+
+	_, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES `+placeholders, args...)
+	return err
+}
+
+// UseTOTPStep marks a time step as used. Codes from that step or earlier are
+// refused afterwards, so an intercepted code can't be replayed.
+func (s *Store) UseTOTPStep(userID, step int64) error {
+	res, err := s.db.Exec(`UPDATE totp_secrets SET last_used_step = ?
+	WHERE user_id = ? AND confirmed_at IS NOT NULL AND last_used_step < ?`, step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("code already used")
+	}
+
+	return nil
+}
+
+// UseRecoveryCode spends a recovery code. Each code works exactly once.
+func (s *Store) UseRecoveryCode(userID int64, code string) error {
+	rows, err := s.db.Query(`SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// The hashes are salted, so the code can't be looked up directly.
+	var id int64
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return err
+		}
+		if utils.CheckRecoveryCode(hash, code) {
+			break
+		}
+		id = 0
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if id == 0 {
+		return errors.New("invalid recovery code")
+	}
+
+	// A concurrent login may have spent the same code in the meantime.
+	res, err := s.db.Exec(`UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("invalid recovery code")
+	}
+
+	return nil
+}
+
+func (s *Store) CreateWebAuthnChallenge(c *types.WebAuthnChallenge) error {
+	userID := sql.NullInt64{Int64: c.UserID, Valid: c.UserID != 0}
+	_, err := s.db.Exec(`INSERT INTO webauthn_challenges (id, user_id, ceremony, challenge, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		c.ID, userID, c.Ceremony, c.Challenge, c.ExpiresAt)
+	return err
+}
+
+// ConsumeWebAuthnChallenge spends a challenge, so every ceremony response can
+// only be checked once.
+func (s *Store) ConsumeWebAuthnChallenge(id, ceremony string) (*types.WebAuthnChallenge, error) {
+	res, err := s.db.Exec(`UPDATE webauthn_challenges SET consumed_at = ?
+	WHERE id = ? AND ceremony = ? AND consumed_at IS NULL AND expires_at > ?`, time.Now(), id, ceremony, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, errors.New("challenge expired or already used")
+	}
+
+	c := types.WebAuthnChallenge{ID: id}
+	var userID sql.NullInt64
+	err = s.db.QueryRow(`SELECT user_id, ceremony, challenge, expires_at FROM webauthn_challenges WHERE id = ?`, id).
+		Scan(&userID, &c.Ceremony, &c.Challenge, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	c.UserID = userID.Int64
+
+	return &c, nil
+}
+
+func (s *Store) DeleteExpiredWebAuthnChallenges() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at < ? OR consumed_at IS NOT NULL`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *Store) AddWebAuthnCredential(c *types.WebAuthnCredential) error {
+	res, err := s.db.Exec(`INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name) VALUES (?, ?, ?, ?, ?)`,
+		c.UserID, c.CredentialID, c.PublicKey, c.SignCount, c.Name)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			return errors.New("passkey already registered")
+		}
+		return err
+	}
+
+	c.ID, _ = res.LastInsertId()
+	c.CreatedAt = time.Now()
+	return nil
+}
+
+func (s *Store) GetWebAuthnCredentials(userID int64) ([]types.WebAuthnCredential, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+	FROM webauthn_credentials WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []types.WebAuthnCredential{}
+	for rows.Next() {
+		c, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *c)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (s *Store) GetWebAuthnCredential(credentialID []byte) (*types.WebAuthnCredential, error) {
+	row := s.db.QueryRow(`SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+	FROM webauthn_credentials WHERE credential_id = ?`, credentialID)
+
+	c, err := scanWebAuthnCredential(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("unknown passkey")
+	}
+
+	return c, err
+}
+
+// UpdateWebAuthnSignCount stores the counter of a successful assertion. It
+// only applies when the counter is still the one the assertion was checked
+// against, so two parallel logins with a cloned key can't both pass.
+func (s *Store) UpdateWebAuthnSignCount(id int64, oldCount, newCount uint32) error {
+	res, err := s.db.Exec(`UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ? AND sign_count = ?`,
+		newCount, time.Now(), id, oldCount)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// Authenticators without a counter always send 0, and a second login in
+	// the same second leaves that row unchanged.
+	if affected == 0 && newCount != 0 {
+		return errors.New("signature counter did not increase, the authenticator may be cloned")
+	}
+
+	return nil
+}
+
+func scanWebAuthnCredential(row interface{ Scan(...any) error }) (*types.WebAuthnCredential, error) {
+	var c types.WebAuthnCredential
+	var lastUsedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.PublicKey, &c.SignCount, &c.Name, &c.CreatedAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	if lastUsedAt.Valid {
+		c.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return &c, nil
+}
+
+func (s *Store) SaveRefreshToken(t *types.RefreshToken) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (token, user_id, device_id, family_id, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		utils.HashToken(t.Token), t.UserID, t.DeviceID, t.FamilyID, t.ExpiresAt)
+	return err
+}
+
+// errRefreshTokenReused tells the handler that RotateRefreshToken revoked the
+// session.
+var errRefreshTokenReused = errors.New("refresh token reused, the session was revoked")
+
+// RotateRefreshToken marks the presented token used and stores its
+// replacement in the same session. A token that was already used means
+// someone else has a copy of it, so the whole session is revoked. Tokens are
+// stored and looked up by their digest only.
+func (s *Store) RotateRefreshToken(token string, next *types.RefreshToken, userAgent, ip string) error {
+	token = utils.HashToken(token)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		deviceID  sql.NullInt64
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRow(`SELECT t.user_id, t.device_id, t.family_id, t.expires_at, t.used_at, s.revoked_at
+	FROM refresh_tokens t
+	JOIN sessions s ON s.id = t.family_id
+	WHERE t.token = ?
+	FOR UPDATE`, token).
+		Scan(&next.UserID, &deviceID, &next.FamilyID, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("invalid refresh token")
+		}
+		return err
+	}
+	next.DeviceID = deviceID.Int64
+
+	if revokedAt.Valid {
+		return errors.New("refresh token revoked")
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ?`, time.Now(), next.FamilyID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return errRefreshTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return errors.New("refresh token expired")
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE token = ?`, time.Now(), token); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token, user_id, device_id, family_id, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		utils.HashToken(next.Token), next.UserID, deviceID, next.FamilyID, next.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE sessions SET last_used_at = ?, expires_at = ?, user_agent = ?, ip = ? WHERE id = ?`,
+		time.Now(), next.ExpiresAt, userAgent, ip, next.FamilyID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) CreateSession(sess *types.Session) error {
+	deviceID := sql.NullInt64{Int64: sess.DeviceID, Valid: sess.DeviceID != 0}
+	_, err := s.db.Exec(`INSERT INTO sessions (id, user_id, device_id, user_agent, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sess.ID, sess.UserID, deviceID, sess.UserAgent, sess.IP, sess.CreatedAt, sess.CreatedAt, sess.ExpiresAt)
+	return err
+}
+
+// GetSessions returns the user's sessions that can still be refreshed, most
+// recently used first.
+func (s *Store) GetSessions(userID int64) ([]types.Session, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, device_id, user_agent, ip, created_at, last_used_at, expires_at
+	FROM sessions
+	WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+	ORDER BY last_used_at DESC`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []types.Session{}
+	for rows.Next() {
+		var (
+			sess       types.Session
+			deviceID   sql.NullInt64
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&sess.ID, &sess.UserID, &deviceID, &sess.UserAgent, &sess.IP, &sess.CreatedAt, &lastUsedAt, &sess.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sess.DeviceID = deviceID.Int64
+		if lastUsedAt.Valid {
+			sess.LastUsedAt = &lastUsedAt.Time
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sessions, rows.Err()
+}
+
+// LookupSession is the utils.SessionLookup used by JWTAuth. Unknown sessions
+// count as revoked.
+func (s *Store) LookupSession(sessionID string) (int64, bool, error) {
+	var (
+		userID    int64
+		revokedAt sql.NullTime
+	)
+	err := s.db.QueryRow(`SELECT user_id, revoked_at FROM sessions WHERE id = ?`, sessionID).Scan(&userID, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return userID, revokedAt.Valid, nil
+}
+
+func (s *Store) RevokeSession(userID int64, sessionID string) error {
+	res, err := s.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		time.Now(), sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("session not found")
+	}
+
+	return nil
+}
+
+// RevokeSessionByRefreshToken revokes the session a refresh token belongs to
+// and returns its ID.
+func (s *Store) RevokeSessionByRefreshToken(userID int64, token string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRow(`SELECT family_id FROM refresh_tokens WHERE token = ? AND user_id = ?`, utils.HashToken(token), userID).
+		Scan(&sessionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errors.New("session not found")
+		}
+		return "", err
+	}
+
+	return sessionID, s.RevokeSession(userID, sessionID)
+}
+
+func (s *Store) RevokeSessions(userID int64) (int64, error) {
+	res, err := s.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
 }
@@ -0,0 +1,143 @@
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"serra/types"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// testStore connects to the database in TEST_DB_DSN, which must be migrated
+// and use parseTime=true, e.g.
+// "root:secret@tcp(localhost:3306)/serra_test?parseTime=true".
+func testStore(t *testing.T) *Store {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewStore(db)
+}
+
+// testDevice creates a user with one device and a key bundle holding
+// poolSize one-time prekeys. Everything is deleted with the user afterwards.
+func testDevice(t *testing.T, s *Store, poolSize int) (int64, int64) {
+	t.Helper()
+
+	name := fmt.Sprintf("prekeys-%d", time.Now().UnixNano())
+	user := &types.User{Username: name, Email: name + "@example.com", Password: "x"}
+	if err := s.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DeleteUser(user.ID) })
+
+	device, err := s.CreateDevice(user.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := make([]types.OneTimePrekey, poolSize)
+	for i := range pool {
+		pool[i] = types.OneTimePrekey{KeyID: uint32(i + 1), PublicKey: fmt.Sprintf("otk-%d", i+1)}
+	}
+
+	signed := types.SignedPrekey{KeyID: 1, PublicKey: "spk", Signature: "sig"}
+	if _, err := s.UpsertPrekeyBundle(user.ID, device.ID, "identity", signed, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	return user.ID, device.ID
+}
+
+func TestGetPrekeyBundlesClaimsEachKeyOnce(t *testing.T) {
+	s := testStore(t)
+
+	const (
+		poolSize = 40
+		fetches  = 60
+	)
+	userID, deviceID := testDevice(t, s, poolSize)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		claimed = map[uint32]int{}
+		empty   int
+		errs    []error
+	)
+	start := make(chan struct{})
+
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			bundles, err := s.GetPrekeyBundles(userID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			if len(bundles) != 1 {
+				errs = append(errs, fmt.Errorf("got %d bundles, want 1", len(bundles)))
+				return
+			}
+
+			id, ok := bundles[0]["one_time_prekey_id"].(uint32)
+			if !ok {
+				empty++
+				return
+			}
+			claimed[id]++
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	for id, n := range claimed {
+		if n > 1 {
+			t.Errorf("one-time prekey %v handed out %d times", id, n)
+		}
+	}
+
+	if len(claimed) != poolSize {
+		t.Errorf("claimed %d distinct keys, want %d", len(claimed), poolSize)
+	}
+
+	if empty != fetches-poolSize {
+		t.Errorf("%d fetches got no one-time prekey, want %d", empty, fetches-poolSize)
+	}
+
+	left, err := s.CountOneTimePrekeys(deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d one-time prekeys left in the pool, want 0", left)
+	}
+}
@@ -6,17 +6,256 @@ type UserStore interface {
 	CreateUser(u *User) error
 	GetUserByEmail(email string) (*User, error)
 	GetUserByID(id int64) (*User, error)
-	UpsertPrekeyBundle(userID int64, identityKey, signedPrekey, signature string, oneTimePrekeys []string) error
-	GetPrekeyBundle(userID int64) (map[string]any, error)
+	CreateDevice(userID int64, name string) (*Device, error)
+	GetDevice(userID, deviceID int64) (*Device, error)
+	UpsertPrekeyBundle(userID, deviceID int64, identityKey string, signedPrekey SignedPrekey, oneTimePrekeys []OneTimePrekey) (bool, error)
+	AddOneTimePrekeys(userID, deviceID int64, oneTimePrekeys []OneTimePrekey) error
+	CountOneTimePrekeys(deviceID int64) (int, error)
+	SetReplenishKeys(deviceID int64, pending bool) error
+	GetIdentityKey(deviceID int64) (string, error)
+	GetIdentityKeys(userID int64) ([]IdentityKey, error)
+	GetPrekeyBundles(userID int64) ([]map[string]any, error)
+	RotateSignedPrekey(deviceID int64, signedPrekey SignedPrekey) error
+	GetSignedPrekeys(deviceID int64, replacedAfter time.Time) ([]SignedPrekey, error)
+	PurgeSignedPrekeyHistory(deviceID int64, replacedBefore time.Time) error
 	SetUserProfile(userID int64, username, profilePic string) error
-	SaveRefreshToken(userID int64, token string, expires time.Time) error
-	GetRefreshToken(token string) (int64, error)
+	CreateUserToken(t *UserToken) error
+	UseUserToken(purpose, tokenHash string) (*UserToken, error)
+	MarkEmailVerified(userID int64) error
+	UpdateEmail(userID int64, email string) error
+	UpdatePassword(userID int64, passwordHash string) error
+	DeleteUnverifiedUsers(createdBefore time.Time) (int64, error)
+	DeleteExpiredUserTokens() (int64, error)
+	ScheduleUserDeletion(userID int64, deleteAfter time.Time) error
+	CancelUserDeletion(userID int64) error
+	GetUsersDueForDeletion(now time.Time) ([]int64, error)
+	DeleteUser(userID int64) ([]int64, error)
+	CreateOTPChallenge(c *OTPChallenge) error
+	RecordOTPAttempt(id string, maxAttempts int) (*OTPChallenge, error)
+	ConsumeOTPChallenge(id string) error
+	DeleteExpiredOTPChallenges() (int64, error)
+	GetTOTPSecret(userID int64) (*TOTPSecret, error)
+	SaveTOTPSecret(userID int64, secret string) error
+	ConfirmTOTPSecret(userID, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(userID, step int64) error
+	UseRecoveryCode(userID int64, code string) error
+	DisableTOTP(userID int64) error
+	ReplaceRecoveryCodes(userID int64, recoveryCodeHashes []string) error
+	CreateWebAuthnChallenge(c *WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(id, ceremony string) (*WebAuthnChallenge, error)
+	DeleteExpiredWebAuthnChallenges() (int64, error)
+	AddWebAuthnCredential(c *WebAuthnCredential) error
+	GetWebAuthnCredentials(userID int64) ([]WebAuthnCredential, error)
+	GetWebAuthnCredential(credentialID []byte) (*WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(id int64, oldCount, newCount uint32) error
+	SaveRefreshToken(t *RefreshToken) error
+	RotateRefreshToken(token string, next *RefreshToken, userAgent, ip string) error
+	CreateSession(s *Session) error
+	GetSessions(userID int64) ([]Session, error)
+	LookupSession(sessionID string) (int64, bool, error)
+	RevokeSession(userID int64, sessionID string) error
+	RevokeSessionByRefreshToken(userID int64, token string) (string, error)
+	RevokeSessions(userID int64) (int64, error)
+}
+
+type MessageStore interface {
+	SaveMessage(e *Envelope) error
+	GetPendingMessages(recipientID, deviceID, afterID int64, limit int) ([]Envelope, error)
+	DeleteMessages(recipientID, deviceID int64, ids []int64) (int64, error)
+	GetReplenishKeys(deviceID int64) (bool, int, error)
+	HasDevice(userID, deviceID int64) (bool, error)
+	QueueEvent(userIDs []int64, event Event) ([]DeviceEvent, error)
+	GetPendingEvents(userID, deviceID, afterID int64, limit int) ([]Event, error)
+	DeleteEvents(userID, deviceID int64, ids []int64) (int64, error)
+	GetConversationPartners(userID int64) ([]int64, error)
+}
+
+// Notifier pushes real-time events to a user's connected sessions.
+// NotifyUsers and NotifyPartners also queue the event for devices that are
+// offline.
+type Notifier interface {
+	Notify(userID int64, event Event)
+	NotifyDevice(userID, deviceID int64, event Event)
+	NotifyUsers(userIDs []int64, event Event)
+	NotifyPartners(userID int64, event Event)
+}
+
+// Mailer delivers plain text mail to a single recipient.
+type Mailer interface {
+	Send(to, subject, body string) error
 }
 
 type User struct {
-	ID         int64  `json:"id"`
-	Username   string `json:"username"`
-	ProfilePic string `json:"profile_pic"`
-	Email      string `json:"email"`
-	Password   string `json:"-"`
+	ID              int64      `json:"id"`
+	Username        string     `json:"username"`
+	ProfilePic      string     `json:"profile_pic"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// DeleteAfter is set while the account is scheduled for deletion.
+	DeleteAfter *time.Time `json:"delete_after"`
+	Password    string     `json:"-"`
+}
+
+// Purposes of the single-use tokens sent by email.
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+	TokenPurposeChangeEmail   = "change_email"
+)
+
+// UserToken is a single-use token sent by email. Only its digest is stored.
+// Data holds what the token is about, e.g. the new address of an email
+// change.
+type UserToken struct {
+	UserID    int64
+	Purpose   string
+	TokenHash string
+	Data      string
+	ExpiresAt time.Time
+}
+
+// OTPChallenge is a pending second-factor check of a login or an account
+// deletion. Only a hash of the code is kept. Method is OTPMethodEmail or
+// OTPMethodTOTP, TOTP challenges have no code hash.
+type OTPChallenge struct {
+	ID         string
+	UserID     int64
+	Method     string
+	Purpose    string
+	CodeHash   string
+	Attempts   int
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+}
+
+const (
+	OTPMethodEmail = "email"
+	OTPMethodTOTP  = "totp"
+)
+
+// What an OTP challenge was created for.
+const (
+	OTPPurposeLogin         = "login"
+	OTPPurposeDeleteAccount = "delete_account"
+)
+
+// TOTPSecret is a user's authenticator app secret. It only counts as a second
+// factor once ConfirmedAt is set.
+type TOTPSecret struct {
+	UserID       int64
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+)
+
+// WebAuthnChallenge is a pending passkey ceremony. Login challenges started
+// without an email have no user.
+type WebAuthnChallenge struct {
+	ID        string
+	UserID    int64
+	Ceremony  string
+	Challenge []byte
+	ExpiresAt time.Time
+}
+
+// WebAuthnCredential is a registered passkey. PublicKey is COSE encoded.
+type WebAuthnCredential struct {
+	ID           int64      `json:"id"`
+	UserID       int64      `json:"-"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Session is one login. Its refresh tokens form a family whose ID is the
+// session ID.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int64      `json:"-"`
+	DeviceID   int64      `json:"device_id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	// Current marks the session of the token that made the request.
+	Current bool `json:"current"`
+}
+
+// RefreshToken is one link of a refresh token family. A family starts at
+// login and gets a new token on every refresh.
+type RefreshToken struct {
+	Token     string
+	UserID    int64
+	DeviceID  int64
+	FamilyID  string
+	ExpiresAt time.Time
+}
+
+// Device is one installation of the app, e.g. a phone or a desktop client.
+// Each device has its own prekey bundle.
+type Device struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SignedPrekey is a medium-term prekey signed by the identity key. ReplacedAt
+// is set once a newer signed prekey took its place.
+type SignedPrekey struct {
+	KeyID      uint32     `json:"key_id"`
+	PublicKey  string     `json:"public_key"`
+	Signature  string     `json:"signature"`
+	ReplacedAt *time.Time `json:"replaced_at,omitempty"`
+}
+
+// IdentityKey is the current identity key of one device and when it was
+// first seen.
+type IdentityKey struct {
+	DeviceID    int64     `json:"device_id"`
+	IdentityKey string    `json:"identity_key"`
+	Fingerprint string    `json:"fingerprint"`
+	Since       time.Time `json:"since"`
+}
+
+type OneTimePrekey struct {
+	KeyID     uint32 `json:"key_id" validate:"gt=0"`
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// Envelope is an end-to-end encrypted message relayed between users. The
+// server never inspects Content, it only routes it to the recipient. DeviceID
+// is the recipient device the ciphertext was encrypted for.
+type Envelope struct {
+	ID             int64     `json:"id"`
+	SenderID       int64     `json:"sender_id"`
+	SenderDeviceID int64     `json:"sender_device_id"`
+	RecipientID    int64     `json:"recipient_id"`
+	DeviceID       int64     `json:"device_id"`
+	Content        []byte    `json:"content"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Event is a frame pushed to a client over its real-time connection. Queued
+// events have an ID the client acknowledges them with.
+type Event struct {
+	ID   int64  `json:"id,omitempty"`
+	Type string `json:"type"`
+	Data any    `json:"data,omitempty"`
+}
+
+// DeviceEvent is a copy of an event queued for one device.
+type DeviceEvent struct {
+	UserID   int64
+	DeviceID int64
+	Event    Event
 }
@@ -4,15 +4,16 @@ import (
 	"context"
 	"errors"
 	"net/http"
-	"serra/config"
 	"strings"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const UserIDKey = contextKey("user_id")
+const (
+	UserIDKey    = contextKey("user_id")
+	DeviceIDKey  = contextKey("device_id")
+	SessionIDKey = contextKey("session_id")
+)
 
 func JWTAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,31 +25,40 @@ func JWTAuth(next http.Handler) http.Handler {
 
 		tokenStr := strings.TrimPrefix(auth, "Bearer ")
 
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(config.Envs.JWTSecret), nil
-		})
-
-		if err != nil || !token.Valid {
-			WriteError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		claims, err := ParseToken(tokenStr, AccessTokenType, AccessTokenAudience)
+		if err != nil {
+			WriteError(w, http.StatusUnauthorized, err)
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			WriteError(w, http.StatusUnauthorized, errors.New("invalid token claims"))
+		userID, err := claims.UserID()
+		if err != nil {
+			WriteError(w, http.StatusUnauthorized, err)
 			return
 		}
 
-		userID, ok := claims["user_id"].(float64)
-		if !ok {
-			WriteError(w, http.StatusUnauthorized, errors.New("user_id not found in token"))
+		// Every access token belongs to a session, so it can be revoked.
+		sessionID := claims.SessionID
+		if sessionID == "" {
+			WriteError(w, http.StatusUnauthorized, errors.New("token has no session"))
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), UserIDKey, int64(userID))
+		if sessions != nil {
+			active, err := sessions.Active(sessionID, userID)
+			if err != nil {
+				WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !active {
+				WriteError(w, http.StatusUnauthorized, errors.New("session revoked"))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, DeviceIDKey, claims.DeviceID)
+		ctx = context.WithValue(ctx, SessionIDKey, sessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
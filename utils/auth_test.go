@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"serra/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testAuth sets up a temporary signing key and a session cache that knows the
+// sessions "active" and "revoked" of user 1.
+func testAuth(t *testing.T) {
+	t.Helper()
+
+	k, err := LoadKeySet("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(sessionID string) (int64, bool, error) {
+		switch sessionID {
+		case "active":
+			return 1, false, nil
+		case "revoked":
+			return 1, true, nil
+		case "someone-else":
+			return 2, false, nil
+		}
+		// Unknown sessions count as revoked, like in the user store.
+		return 0, true, nil
+	}
+
+	oldKeys, oldSessions := keys, sessions
+	SetKeySet(k)
+	SetSessionCache(NewSessionCache(lookup, time.Minute))
+	t.Cleanup(func() {
+		keys, sessions = oldKeys, oldSessions
+	})
+}
+
+// accessClaims are the claims of a valid access token of session "active".
+func accessClaims(t *testing.T) *Claims {
+	t.Helper()
+
+	claims, err := newClaims(AccessTokenType, AccessTokenAudience, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.Subject = "1"
+	claims.DeviceID = 2
+	claims.SessionID = "active"
+
+	return claims
+}
+
+func signed(t *testing.T, k *KeySet, claims *Claims) string {
+	t.Helper()
+
+	token, err := k.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func serveAuth(authorization string) *httptest.ResponseRecorder {
+	handler := JWTAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]any{
+			"user_id":    r.Context().Value(UserIDKey),
+			"device_id":  r.Context().Value(DeviceIDKey),
+			"session_id": r.Context().Value(SessionIDKey),
+		})
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestJWTAuthAccepts(t *testing.T) {
+	testAuth(t)
+
+	w := serveAuth("Bearer " + signed(t, keys, accessClaims(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+
+	var body struct {
+		Data struct {
+			UserID    int64  `json:"user_id"`
+			DeviceID  int64  `json:"device_id"`
+			SessionID string `json:"session_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Data.UserID != 1 || body.Data.DeviceID != 2 || body.Data.SessionID != "active" {
+		t.Errorf("got context %+v, want user 1, device 2, session active", body.Data)
+	}
+}
+
+func TestJWTAuthRejects(t *testing.T) {
+	testAuth(t)
+
+	other, err := LoadKeySet("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leeway := config.Envs.JWTLeeway
+
+	// A signature taken from another token of the same key.
+	forged := func() string {
+		a := signed(t, keys, accessClaims(t))
+		claims := accessClaims(t)
+		claims.Subject = "3"
+		b := signed(t, keys, claims)
+		return b[:strings.LastIndex(b, ".")] + a[strings.LastIndex(a, "."):]
+	}
+
+	hmac := func() string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims(t)).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	with := func(change func(c *Claims)) string {
+		claims := accessClaims(t)
+		change(claims)
+		return signed(t, keys, claims)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		message       string
+	}{
+		{"no header", "", http.StatusUnauthorized, "missing or invalid Authorization header"},
+		{"basic auth", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, "missing or invalid Authorization header"},
+		{"bearer without token", "Bearer", http.StatusUnauthorized, "missing or invalid Authorization header"},
+		{"malformed token", "Bearer not-a-token", http.StatusUnauthorized, "invalid token"},
+		{"bad signature", "Bearer " + forged(), http.StatusUnauthorized, "invalid token"},
+		{"unknown kid", "Bearer " + signed(t, other, accessClaims(t)), http.StatusUnauthorized, "invalid token"},
+		{"HMAC signed", "Bearer " + hmac(), http.StatusUnauthorized, "invalid token"},
+		{"wrong issuer", "Bearer " + with(func(c *Claims) { c.Issuer = "someone-else" }), http.StatusUnauthorized, "token not meant for this service"},
+		{"wrong audience", "Bearer " + with(func(c *Claims) { c.Audience = jwt.ClaimStrings{OTPTokenAudience} }), http.StatusUnauthorized, "token not meant for this service"},
+		{"OTP token", "Bearer " + with(func(c *Claims) { c.Type = OTPTokenType }), http.StatusUnauthorized, "wrong token type"},
+		{"expired", "Bearer " + with(func(c *Claims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-leeway - time.Minute))
+		}), http.StatusUnauthorized, "token expired"},
+		{"no expiry", "Bearer " + with(func(c *Claims) { c.ExpiresAt = nil }), http.StatusUnauthorized, "invalid token"},
+		{"not valid yet", "Bearer " + with(func(c *Claims) {
+			c.NotBefore = jwt.NewNumericDate(time.Now().Add(leeway + time.Minute))
+		}), http.StatusUnauthorized, "token not valid yet"},
+		{"issued in the future", "Bearer " + with(func(c *Claims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(leeway + time.Minute))
+		}), http.StatusUnauthorized, "token not valid yet"},
+		{"non-numeric subject", "Bearer " + with(func(c *Claims) { c.Subject = "alice" }), http.StatusUnauthorized, "invalid token subject"},
+		{"zero subject", "Bearer " + with(func(c *Claims) { c.Subject = "0" }), http.StatusUnauthorized, "invalid token subject"},
+		{"missing sid", "Bearer " + with(func(c *Claims) { c.SessionID = "" }), http.StatusUnauthorized, "token has no session"},
+		{"revoked session", "Bearer " + with(func(c *Claims) { c.SessionID = "revoked" }), http.StatusUnauthorized, "session revoked"},
+		{"unknown session", "Bearer " + with(func(c *Claims) { c.SessionID = "deleted" }), http.StatusUnauthorized, "session revoked"},
+		{"session of another user", "Bearer " + with(func(c *Claims) { c.SessionID = "someone-else" }), http.StatusUnauthorized, "session revoked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAuth(tt.authorization)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+
+			var body struct {
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Message != tt.message {
+				t.Errorf("got message %q, want %q", body.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestJWTAuthLeeway(t *testing.T) {
+	testAuth(t)
+
+	leeway := config.Envs.JWTLeeway
+	if leeway < 2*time.Second {
+		t.Skip("leeway too small to test")
+	}
+
+	claims := accessClaims(t)
+	claims.NotBefore = jwt.NewNumericDate(time.Now().Add(leeway / 2))
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-leeway / 2))
+	claims.IssuedAt = claims.NotBefore
+
+	if w := serveAuth("Bearer " + signed(t, keys, claims)); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200 within the leeway", w.Code, w.Body)
+	}
+}
+
+func TestJWTAuthInvalidatedSession(t *testing.T) {
+	testAuth(t)
+
+	revoked := false
+	SetSessionCache(NewSessionCache(func(string) (int64, bool, error) {
+		return 1, revoked, nil
+	}, time.Hour))
+
+	token := "Bearer " + signed(t, keys, accessClaims(t))
+	if w := serveAuth(token); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+
+	revoked = true
+	InvalidateSession("active")
+	if w := serveAuth(token); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d after invalidating the session, want 401", w.Code)
+	}
+}
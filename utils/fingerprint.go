@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+)
+
+// IdentityFingerprint returns the 30 digit displayable fingerprint of an
+// identity key, computed like libsignal's numeric fingerprints. Two users get
+// their safety number by concatenating both fingerprints, lowest first.
+func IdentityFingerprint(userID int64, identityKey string) (string, error) {
+	_, key, err := decodePublicKey("identity_key", identityKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Fingerprints always cover the libsignal serialization.
+	serialized := append([]byte{djbKeyType}, key...)
+
+	hash := []byte{0, fingerprintVersion}
+	hash = append(hash, serialized...)
+	hash = append(hash, strconv.FormatInt(userID, 10)...)
+
+	for i := 0; i < fingerprintIterations; i++ {
+		sum := sha512.Sum512(append(hash, serialized...))
+		hash = sum[:]
+	}
+
+	var b strings.Builder
+	for offset := 0; offset < 30; offset += 5 {
+		chunk := uint64(hash[offset])<<32 | uint64(hash[offset+1])<<24 | uint64(hash[offset+2])<<16 |
+			uint64(hash[offset+3])<<8 | uint64(hash[offset+4])
+		fmt.Fprintf(&b, "%05d", chunk%100000)
+	}
+
+	return b.String(), nil
+}
@@ -2,26 +2,129 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"serra/config"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateJWT(userID int64) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-		"iat":     time.Now().Unix(),
+// Access tokens and OTP tokens are signed with the same keys. Their type and
+// audience keep one from being used as the other.
+const (
+	AccessTokenType = "access"
+	OTPTokenType    = "otp"
+
+	AccessTokenAudience = "serra-api"
+	OTPTokenAudience    = "serra-otp"
+
+	accessTokenTTL = 24 * time.Hour
+)
+
+// Claims are the claims of every token Serra issues. The subject of access
+// tokens is the user ID.
+type Claims struct {
+	jwt.RegisteredClaims
+	Type        string `json:"typ"`
+	DeviceID    int64  `json:"device_id,omitempty"`
+	SessionID   string `json:"sid,omitempty"`
+	Email       string `json:"email,omitempty"`
+	ChallengeID string `json:"cid,omitempty"`
+}
+
+// UserID parses the subject of an access token.
+func (c *Claims) UserID() (int64, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid token subject")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.Envs.JWTSecret))
+	return id, nil
+}
+
+// newClaims fills in the registered claims shared by all tokens.
+func newClaims(tokenType, audience string, ttl time.Duration) (*Claims, error) {
+	jti, err := GenerateRandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    config.Envs.JWTIssuer,
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+		Type: tokenType,
+	}, nil
+}
+
+// ParseToken verifies a token's signature, issuer, audience and lifetime and
+// makes sure it is of the expected type.
+func ParseToken(tokenStr, tokenType, audience string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, keys.keyFunc,
+		jwt.WithIssuer(config.Envs.JWTIssuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(config.Envs.JWTLeeway),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return nil, errors.New("token expired")
+		case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+			return nil, errors.New("token not valid yet")
+		case errors.Is(err, jwt.ErrTokenInvalidIssuer), errors.Is(err, jwt.ErrTokenInvalidAudience):
+			return nil, errors.New("token not meant for this service")
+		default:
+			return nil, errors.New("invalid token")
+		}
+	}
+
+	if claims.Type != tokenType {
+		return nil, errors.New("wrong token type")
+	}
+
+	return claims, nil
+}
+
+// GenerateJWT issues an access token for a session. JWTAuth rejects it once
+// the session is revoked.
+func GenerateJWT(userID, deviceID int64, sessionID string) (string, error) {
+	claims, err := newClaims(AccessTokenType, AccessTokenAudience, accessTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	claims.Subject = strconv.FormatInt(userID, 10)
+	claims.DeviceID = deviceID
+	claims.SessionID = sessionID
+
+	return keys.sign(claims)
 }
 
 func GenerateRefreshToken() (string, error) {
-	b := make([]byte, 32)
+	return GenerateRandomHex(32)
+}
+
+// HashToken returns the hex SHA-256 digest a random token is stored as. The
+// tokens are long random strings, so they need no salt or slow hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateRandomHex returns n random bytes, hex encoded.
+func GenerateRandomHex(n int) (string, error) {
+	b := make([]byte, n)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
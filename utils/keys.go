@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet holds the Ed25519 key tokens are signed with and every public key
+// tokens are still accepted from. Keys are identified by their RFC 7638
+// thumbprint, which goes into the kid header.
+type KeySet struct {
+	signer     ed25519.PrivateKey
+	signingKID string
+	public     map[string]ed25519.PublicKey
+	// order keeps the JWKS output stable, signing key first.
+	order []string
+}
+
+// keys is used to sign and verify all tokens.
+var keys *KeySet
+
+func SetKeySet(k *KeySet) {
+	keys = k
+}
+
+// LoadKeySet reads the PKCS #8 PEM signing key and the PKIX PEM public keys
+// of retired signing keys. Without a signing key a temporary one is
+// generated, so tokens don't survive a restart.
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	var signer ed25519.PrivateKey
+	if signingKeyFile == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer = priv
+	} else {
+		block, err := readPEM(signingKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an Ed25519 private key", signingKeyFile)
+		}
+		signer = priv
+	}
+
+	k := &KeySet{signer: signer, public: make(map[string]ed25519.PublicKey)}
+	k.signingKID = k.add(signer.Public().(ed25519.PublicKey))
+
+	for _, file := range verificationKeyFiles {
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an Ed25519 public key", file)
+		}
+		k.add(pub)
+	}
+
+	return k, nil
+}
+
+func (k *KeySet) add(pub ed25519.PublicKey) string {
+	kid := thumbprint(pub)
+	if _, ok := k.public[kid]; !ok {
+		k.public[kid] = pub
+		k.order = append(k.order, kid)
+	}
+
+	return kid
+}
+
+// SigningKID is the kid of the key new tokens are signed with.
+func (k *KeySet) SigningKID() string {
+	return k.signingKID
+}
+
+// sign signs the claims with the current key.
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = k.signingKID
+	return token.SignedString(k.signer)
+}
+
+// keyFunc picks the verification key named by the token's kid.
+func (k *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	pub, ok := k.public[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+
+	return pub, nil
+}
+
+// JWKS returns the verification keys as a JSON Web Key Set.
+func (k *KeySet) JWKS() map[string]any {
+	list := make([]map[string]any, 0, len(k.order))
+	for _, kid := range k.order {
+		list = append(list, map[string]any{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   EncodeBase64URL(k.public[kid]),
+			"kid": kid,
+			"use": "sig",
+			"alg": "EdDSA",
+		})
+	}
+
+	return map[string]any{"keys": list}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint of an Ed25519 key.
+func thumbprint(pub ed25519.PublicKey) string {
+	// The members have to be in lexicographic order without whitespace,
+	// which is what encoding/json produces for a map.
+	b, _ := json.Marshal(map[string]string{
+		"crv": "Ed25519",
+		"kty": "OKP",
+		"x":   EncodeBase64URL(pub),
+	})
+	sum := sha256.Sum256(b)
+
+	return EncodeBase64URL(sum[:])
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+
+	return block, nil
+}
@@ -1,41 +1,124 @@
 package utils
 
 import (
-	"serra/config"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
 	"time"
+)
 
-	"github.com/golang-jwt/jwt/v5"
+const (
+	minOTPLength = 4
+	maxOTPLength = 32
+	// minOTPSpace keeps configured codes at least as hard to guess as six digits.
+	minOTPSpace = 1e6
 )
 
-func GenerateOTPToken(email, otp string, ttl time.Duration) (string, error) {
-	claims := jwt.MapClaims{
-		"email": email,
-		"otp":   otp,
-		"exp":   time.Now().Add(ttl).Unix(),
-		"iat":   time.Now().Unix(),
+// OTPService generates login codes from a configurable alphabet using
+// crypto/rand.
+type OTPService struct {
+	length   int
+	alphabet []rune
+	ttl      time.Duration
+}
+
+func NewOTPService(length int, alphabet string, ttl time.Duration) (*OTPService, error) {
+	if length < minOTPLength || length > maxOTPLength {
+		return nil, fmt.Errorf("OTP length must be between %d and %d", minOTPLength, maxOTPLength)
+	}
+
+	runes := []rune(alphabet)
+	seen := make(map[rune]bool, len(runes))
+	for _, r := range runes {
+		if seen[r] {
+			return nil, fmt.Errorf("OTP alphabet has duplicate character %q", r)
+		}
+		seen[r] = true
+	}
+	if len(runes) < 2 {
+		return nil, errors.New("OTP alphabet needs at least 2 characters")
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.Envs.JWTSecret))
+
+	if math.Pow(float64(len(runes)), float64(length)) < minOTPSpace {
+		return nil, errors.New("OTP length and alphabet allow fewer than 1000000 codes")
+	}
+
+	if ttl <= 0 {
+		return nil, errors.New("OTP TTL must be positive")
+	}
+
+	return &OTPService{length: length, alphabet: runes, ttl: ttl}, nil
 }
 
-func VerifyOTPToken(tokenStr string) (string, string, error) {
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrTokenMalformed
+// GenerateCode returns a uniformly random code.
+func (s *OTPService) GenerateCode() (string, error) {
+	var b strings.Builder
+	size := big.NewInt(int64(len(s.alphabet)))
+
+	for i := 0; i < s.length; i++ {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
 		}
-		return []byte(config.Envs.JWTSecret), nil
-	})
-	if err != nil || !token.Valid {
-		return "", "", err
+		b.WriteRune(s.alphabet[n.Int64()])
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", "", jwt.ErrTokenMalformed
+	return b.String(), nil
+}
+
+// ValidCode reports whether the code has the configured length and only uses
+// characters from the alphabet.
+func (s *OTPService) ValidCode(code string) bool {
+	runes := []rune(code)
+	if len(runes) != s.length {
+		return false
 	}
 
-	email, _ := claims["email"].(string)
-	otp, _ := claims["otp"].(string)
+	for _, r := range runes {
+		if !strings.ContainsRune(string(s.alphabet), r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *OTPService) Length() int {
+	return s.length
+}
+
+func (s *OTPService) TTL() time.Duration {
+	return s.ttl
+}
+
+// TTLText renders the TTL for humans, e.g. "5 minutes".
+func (s *OTPService) TTLText() string {
+	return FormatDuration(s.ttl)
+}
+
+func GenerateOTPToken(email, challengeID string, ttl time.Duration) (string, error) {
+	claims, err := newClaims(OTPTokenType, OTPTokenAudience, ttl)
+	if err != nil {
+		return "", err
+	}
+	claims.Email = email
+	claims.ChallengeID = challengeID
+
+	return keys.sign(claims)
+}
+
+func VerifyOTPToken(tokenStr string) (string, string, error) {
+	claims, err := ParseToken(tokenStr, OTPTokenType, OTPTokenAudience)
+	if err != nil {
+		return "", "", err
+	}
+
+	if claims.ChallengeID == "" {
+		return "", "", errors.New("invalid token")
+	}
 
-	return email, otp, nil
+	return claims.Email, claims.ChallengeID, nil
 }
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const digits = "0123456789"
+
+func TestNewOTPService(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		alphabet string
+		ttl      time.Duration
+		wantErr  string
+	}{
+		{"length 3", 3, digits, time.Minute, "between 4 and 32"},
+		{"length 4", 4, "ABCDEFGHJKLMNPQRSTUVWXYZ23456789", time.Minute, ""},
+		{"length 4 below the minimum space", 4, "0123456789ABCDEF", time.Minute, "fewer than 1000000 codes"},
+		{"length 32", 32, digits, time.Minute, ""},
+		{"length 33", 33, digits, time.Minute, "between 4 and 32"},
+		{"one character", 32, "7", time.Minute, "at least 2 characters"},
+		{"duplicate character", 6, "01234567890", time.Minute, "duplicate character '0'"},
+		{"five digits", 5, digits, time.Minute, "fewer than 1000000 codes"},
+		{"six digits", 6, digits, time.Minute, ""},
+		{"zero TTL", 6, digits, 0, "TTL must be positive"},
+		{"negative TTL", 6, digits, -time.Second, "TTL must be positive"},
+		{"multi-byte alphabet", 6, "αβγδεζηθικ", time.Minute, ""},
+		{"multi-byte duplicate", 6, "αβγδεζηθια", time.Minute, "duplicate character 'α'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewOTPService(tt.length, tt.alphabet, tt.ttl)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if s.Length() != tt.length || s.TTL() != tt.ttl {
+					t.Errorf("got length %d and TTL %v, want %d and %v", s.Length(), s.TTL(), tt.length, tt.ttl)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateCodeUsesAlphabet(t *testing.T) {
+	for _, alphabet := range []string{digits, "ACDEFHJKMNPRTWXY", "αβγδεζηθικ"} {
+		s, err := NewOTPService(8, alphabet, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 200; i++ {
+			code, err := s.GenerateCode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := utf8.RuneCountInString(code); n != 8 {
+				t.Fatalf("code %q has %d characters, want 8", code, n)
+			}
+			for _, r := range code {
+				if !strings.ContainsRune(alphabet, r) {
+					t.Fatalf("code %q has %q, which is not in %q", code, r, alphabet)
+				}
+			}
+			if !s.ValidCode(code) {
+				t.Fatalf("generated code %q is not valid", code)
+			}
+		}
+	}
+}
+
+func TestValidCode(t *testing.T) {
+	s, err := NewOTPService(6, digits, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greek, err := NewOTPService(6, "αβγδεζηθικ", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		service *OTPService
+		code    string
+		want    bool
+	}{
+		{"valid", s, "012345", true},
+		{"too short", s, "01234", false},
+		{"too long", s, "0123456", false},
+		{"empty", s, "", false},
+		{"letter", s, "01234a", false},
+		{"space", s, "012 45", false},
+		{"full-width digit", s, "01234５", false},
+		{"multi-byte valid", greek, "αβγδεζ", true},
+		{"multi-byte counted in characters", greek, "αβγ", false},
+		{"multi-byte foreign character", greek, "αβγδεω", false},
+		{"ascii for multi-byte alphabet", greek, "abcdef", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.service.ValidCode(tt.code); got != tt.want {
+				t.Errorf("ValidCode(%q) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
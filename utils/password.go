@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBcryptLength is the most bcrypt hashes, longer passwords are rejected
+// by bcrypt.GenerateFromPassword.
+const maxBcryptLength = 72
+
+// PasswordPolicy decides which new passwords are accepted. Existing
+// passwords are never checked against it, so tightening it doesn't lock
+// anyone out.
+type PasswordPolicy struct {
+	minLength int
+	maxLength int
+	minScore  int
+	breached  *BreachedPasswords
+}
+
+// PasswordViolation is one reason a password was refused. Code is stable for
+// clients, Message is for humans.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes of password violations.
+const (
+	PasswordTooShort = "too_short"
+	PasswordTooLong  = "too_long"
+	PasswordTooWeak  = "too_weak"
+	PasswordBreached = "breached"
+)
+
+// NewPasswordPolicy checks the limits. Lengths count characters, except that
+// bcrypt can't take more than 72 bytes. breached may be nil.
+func NewPasswordPolicy(minLength, maxLength, minScore int, breached *BreachedPasswords) (*PasswordPolicy, error) {
+	if minLength < 1 {
+		return nil, errors.New("password min length must be at least 1")
+	}
+
+	if maxLength < minLength {
+		return nil, errors.New("password max length must not be below the min length")
+	}
+
+	if maxLength > maxBcryptLength {
+		return nil, fmt.Errorf("password max length can't exceed %d, bcrypt ignores the rest", maxBcryptLength)
+	}
+
+	if minScore < 0 || minScore > 4 {
+		return nil, errors.New("password min score must be between 0 and 4")
+	}
+
+	return &PasswordPolicy{minLength: minLength, maxLength: maxLength, minScore: minScore, breached: breached}, nil
+}
+
+// Check returns everything wrong with a new password, or nothing when it is
+// accepted. userInputs like the email address count against its strength.
+func (p *PasswordPolicy) Check(password string, userInputs ...string) ([]PasswordViolation, error) {
+	violations := []PasswordViolation{}
+	length := utf8.RuneCountInString(password)
+
+	if length < p.minLength {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters", p.minLength),
+		})
+	}
+
+	if length > p.maxLength || len(password) > maxBcryptLength {
+		message := fmt.Sprintf("password must be at most %d characters", p.maxLength)
+		if length <= p.maxLength {
+			message = fmt.Sprintf("password must be at most %d bytes, some characters take more than one", maxBcryptLength)
+		}
+		violations = append(violations, PasswordViolation{Code: PasswordTooLong, Message: message})
+		// Scoring very long input is wasted work.
+		return violations, nil
+	}
+
+	if p.minScore > 0 {
+		strength := EstimatePasswordStrength(password, userInputs...)
+		if strength.Score < p.minScore {
+			message := "password is too easy to guess"
+			if strength.Warning != "" {
+				message += ". " + strength.Warning
+			}
+			violations = append(violations, PasswordViolation{Code: PasswordTooWeak, Message: message})
+		}
+	}
+
+	if p.breached != nil {
+		count, err := p.breached.Count(password)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			violations = append(violations, PasswordViolation{
+				Code:    PasswordBreached,
+				Message: "password appeared in a data breach, choose another one",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+// BreachedPasswords looks passwords up in an offline copy of the Pwned
+// Passwords range files. The directory holds one file per 5 character SHA-1
+// prefix, named like "21BD1.txt", with "SUFFIX:COUNT" lines as returned by
+// the k-anonymity range API. Only the prefix file of a password is read.
+type BreachedPasswords struct {
+	dir string
+}
+
+func NewBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+
+	return &BreachedPasswords{dir: dir}, nil
+}
+
+// Count returns how often the password appeared in breaches. Prefixes
+// without a file count as not breached.
+func (b *BreachedPasswords) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		s, count, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid count %q", file.Name(), count)
+		}
+		return n, nil
+	}
+
+	return 0, scanner.Err()
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name               string
+		min, max, minScore int
+		wantErr            string
+	}{
+		{"defaults", 8, 64, 3, ""},
+		{"bcrypt limit", 1, maxBcryptLength, 0, ""},
+		{"min below 1", 0, 64, 3, "min length must be at least 1"},
+		{"max below min", 12, 8, 3, "must not be below the min length"},
+		{"max above bcrypt limit", 8, maxBcryptLength + 1, 3, "can't exceed 72"},
+		{"negative score", 8, 64, -1, "between 0 and 4"},
+		{"score above 4", 8, 64, 5, "between 0 and 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPasswordPolicy(tt.min, tt.max, tt.minScore, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testBreached writes the range file of prefix 5BAA6. It holds the digest of
+// "password", 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8, but not the one of
+// "miss523380", 5BAA61DD7A0B45F6034D252E89A28872A619F09E.
+func testBreached(t *testing.T) *BreachedPasswords {
+	t.Helper()
+
+	dir := t.TempDir()
+	lines := "003D68EB55068C33ACE09247EE4C639306B:3\r\n" +
+		"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n" +
+		"1E4C9B93F3F0682250B6CF8331B7EE68FD9:0\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestBreachedPasswordsCount(t *testing.T) {
+	b := testBreached(t)
+
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"hit", "password", 9545824},
+		{"miss in an existing prefix file", "miss523380", 0},
+		{"miss without a prefix file", "xK9#mQ2$vL7p", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.Count(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Count(%q) = %d, want %d", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswordsInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:many\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Count("password"); err == nil || !strings.Contains(err.Error(), "invalid count") {
+		t.Fatalf("got error %v, want an invalid count", err)
+	}
+}
+
+func TestNewBreachedPasswordsNeedsDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "5BAA6.txt")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBreachedPasswords(file); err == nil {
+		t.Error("a file was accepted as the breached passwords directory")
+	}
+
+	if _, err := NewBreachedPasswords(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing directory was accepted")
+	}
+}
+
+// longPassword is a strong password of exactly 64 characters.
+const longPassword = "PtYgj-mUh%Bel31iEl2hpChYgCfrL1s=pNxnyVmihA$-2O76UMFxFkM+$R5Kjp&1"
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy, err := NewPasswordPolicy(8, 64, 3, testBreached(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		inputs   []string
+		want     []string
+		message  string
+	}{
+		{"accepted", "xK9#mQ2$vL7p", nil, nil, ""},
+		{"too short", "xK9#mQ", nil, []string{PasswordTooShort, PasswordTooWeak}, "password must be at least 8 characters"},
+		{"short in bytes but long enough in characters", "éàüöñçøå", nil, []string{PasswordTooWeak}, ""},
+		{"too long in characters", longPassword + "m", nil, []string{PasswordTooLong}, "password must be at most 64 characters"},
+		{"too long in bytes", strings.Repeat("é", 40), nil, []string{PasswordTooLong}, "password must be at most 72 bytes, some characters take more than one"},
+		{"at the limit", longPassword, nil, nil, ""},
+		{"weak and breached", "password", nil, []string{PasswordTooWeak, PasswordBreached}, "password is too easy to guess. " + commonWarning},
+		{"email as password", "john.smith@example.com", []string{"john.smith@example.com"}, []string{PasswordTooWeak}, "password is too easy to guess. " + inputWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := policy.Check(tt.password, tt.inputs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var codes []string
+			for _, v := range violations {
+				codes = append(codes, v.Code)
+			}
+			if strings.Join(codes, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got violations %v, want %v", codes, tt.want)
+			}
+
+			if tt.message != "" && violations[0].Message != tt.message {
+				t.Errorf("got message %q, want %q", violations[0].Message, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionLookup reports who a session belongs to and whether it was revoked.
+type SessionLookup func(sessionID string) (userID int64, revoked bool, err error)
+
+// SessionCache remembers session lookups for a short while, so JWTAuth
+// doesn't hit the database on every request. Revoking a session has to
+// invalidate it here as well, otherwise its access tokens keep working until
+// the entry expires.
+type SessionCache struct {
+	lookup SessionLookup
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]sessionEntry
+	lastSweep time.Time
+	// generation counts invalidations. A lookup that overlapped one may have
+	// read the session before it was revoked, so its result isn't cached.
+	generation uint64
+}
+
+type sessionEntry struct {
+	userID    int64
+	revoked   bool
+	expiresAt time.Time
+}
+
+// sessions is used by JWTAuth. Without it sessions aren't checked.
+var sessions *SessionCache
+
+func NewSessionCache(lookup SessionLookup, ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		lookup:    lookup,
+		ttl:       ttl,
+		entries:   make(map[string]sessionEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// SessionListener is told about invalidated sessions, so connections that
+// outlive the request they were authenticated with can be closed.
+type SessionListener interface {
+	DisconnectSession(sessionID string)
+	DisconnectUser(userID int64)
+}
+
+var listener SessionListener
+
+// SetSessionCache makes JWTAuth check sessions through c.
+func SetSessionCache(c *SessionCache) {
+	sessions = c
+}
+
+// SetSessionListener makes invalidating sessions also tell l.
+func SetSessionListener(l SessionListener) {
+	listener = l
+}
+
+// InvalidateSession marks a revoked session in the cache.
+func InvalidateSession(sessionID string) {
+	if sessions != nil {
+		sessions.mu.Lock()
+		sessions.entries[sessionID] = sessionEntry{revoked: true, expiresAt: time.Now().Add(sessions.ttl)}
+		sessions.generation++
+		sessions.mu.Unlock()
+	}
+
+	if listener != nil {
+		listener.DisconnectSession(sessionID)
+	}
+}
+
+// InvalidateUserSessions drops all cached sessions of a user, e.g. after
+// logging out everywhere.
+func InvalidateUserSessions(userID int64) {
+	if sessions != nil {
+		sessions.mu.Lock()
+		for id, e := range sessions.entries {
+			if e.userID == userID {
+				delete(sessions.entries, id)
+			}
+		}
+		sessions.generation++
+		sessions.mu.Unlock()
+	}
+
+	if listener != nil {
+		listener.DisconnectUser(userID)
+	}
+}
+
+// Active reports whether the session exists, belongs to the user and wasn't
+// revoked.
+func (c *SessionCache) Active(sessionID string, userID int64) (bool, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[sessionID]
+	generation := c.generation
+	c.mu.Unlock()
+
+	for !ok || now.After(e.expiresAt) {
+		owner, revoked, err := c.lookup(sessionID)
+		if err != nil {
+			return false, err
+		}
+
+		c.mu.Lock()
+		if c.generation != generation {
+			// Sessions were invalidated during the lookup. Take the revoked
+			// mark if this one got it, or look it up again.
+			e, ok = c.entries[sessionID]
+			generation = c.generation
+			c.mu.Unlock()
+			continue
+		}
+
+		e = sessionEntry{userID: owner, revoked: revoked, expiresAt: now.Add(c.ttl)}
+		if cur, found := c.entries[sessionID]; found && cur.revoked {
+			// Revoked sessions stay revoked.
+			e = cur
+		}
+		c.entries[sessionID] = e
+		c.sweep(now)
+		c.mu.Unlock()
+		ok = true
+	}
+
+	return !e.revoked && e.userID == userID, nil
+}
+
+// sweep drops expired entries once per TTL. The caller holds c.mu.
+func (c *SessionCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+
+	for id, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionCacheInvalidatedDuringLookup(t *testing.T) {
+	revoked := false
+	looking := make(chan struct{})
+	resume := make(chan struct{})
+
+	c := NewSessionCache(func(string) (int64, bool, error) {
+		stale := revoked
+		if looking != nil {
+			// Hold the first lookup, which read the session as active,
+			// until the session was revoked.
+			close(looking)
+			looking = nil
+			<-resume
+		}
+		return 1, stale, nil
+	}, time.Hour)
+	SetSessionCache(c)
+	t.Cleanup(func() { SetSessionCache(nil) })
+
+	started := looking
+	done := make(chan bool)
+	go func() {
+		active, err := c.Active("s1", 1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- active
+	}()
+
+	<-started
+	revoked = true
+	InvalidateSession("s1")
+	close(resume)
+
+	if <-done {
+		t.Error("a lookup that overlapped the revocation reported the session active")
+	}
+
+	if active, _ := c.Active("s1", 1); active {
+		t.Error("the stale lookup result was cached")
+	}
+}
@@ -0,0 +1,453 @@
+package utils
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The strength estimate follows zxcvbn: the password is split into the
+// sequence of patterns (common passwords, sequences, repeats, keyboard rows,
+// years, brute force) an attacker would need the fewest guesses for, and the
+// score is the order of magnitude of that number.
+
+// PasswordStrength is the estimate for a password. Score goes from 0 (too
+// guessable) to 4 (very unguessable).
+type PasswordStrength struct {
+	Score   int
+	Guesses float64
+	// Warning explains the weakest part of the password, if there is one.
+	Warning string
+}
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords maps the most used passwords to their rank.
+var commonPasswords = rankedWords(commonPasswordList)
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+const (
+	minSequenceLength = 3
+	minKeyboardLength = 4
+	// minYearSpace is how many years an attacker tries around the current one.
+	minYearSpace = 20
+	// extraMatchGuesses is added for every pattern after the first, so a
+	// split into many small patterns doesn't look cheaper than it is.
+	extraMatchGuesses = 10000
+)
+
+type strengthEstimator struct {
+	inputs map[string]int
+	// blocks remembers the estimates of repeated blocks.
+	blocks map[string]float64
+}
+
+type strengthMatch struct {
+	i, j    int // rune positions, inclusive
+	guesses float64
+	warning string
+}
+
+// EstimatePasswordStrength scores a password. userInputs are strings that
+// shouldn't count as secret, like the email address.
+func EstimatePasswordStrength(password string, userInputs ...string) PasswordStrength {
+	e := &strengthEstimator{inputs: rankedInputs(userInputs), blocks: make(map[string]float64)}
+	guesses, warning := e.guesses([]rune(password))
+
+	return PasswordStrength{Score: strengthScore(guesses), Guesses: guesses, Warning: warning}
+}
+
+func strengthScore(guesses float64) int {
+	switch {
+	case guesses < 1e3+5:
+		return 0
+	case guesses < 1e6+5:
+		return 1
+	case guesses < 1e8+5:
+		return 2
+	case guesses < 1e10+5:
+		return 3
+	}
+
+	return 4
+}
+
+// guesses finds the cheapest way to cover the password with matches.
+func (e *strengthEstimator) guesses(password []rune) (float64, string) {
+	n := len(password)
+	if n == 0 {
+		return 1, ""
+	}
+
+	matches := e.findMatches(password)
+	byEnd := make([][]strengthMatch, n)
+	for _, m := range matches {
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+
+	// best[k][l] is the fewest guesses for the first k runes using l matches,
+	// last[k][l] the match that ends the cheapest split.
+	best := make([][]float64, n+1)
+	last := make([][]*strengthMatch, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		last[k] = make([]*strengthMatch, n+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+
+	for k := 1; k <= n; k++ {
+		for idx := range byEnd[k-1] {
+			m := &byEnd[k-1][idx]
+			for l := 0; l < n; l++ {
+				if g := best[m.i][l] * m.guesses; g < best[k][l+1] {
+					best[k][l+1] = g
+					last[k][l+1] = m
+				}
+			}
+		}
+	}
+
+	guesses, count := math.Inf(1), 0
+	for l := 1; l <= n; l++ {
+		g := factorial(l)*best[n][l] + math.Pow(extraMatchGuesses, float64(l-1))
+		if g < guesses {
+			guesses, count = g, l
+		}
+	}
+
+	// The warning comes from the longest pattern in the cheapest split.
+	warning, longest := "", 0
+	for k, l := n, count; k > 0 && l > 0; l-- {
+		m := last[k][l]
+		if m.warning != "" && m.j-m.i+1 > longest {
+			warning, longest = m.warning, m.j-m.i+1
+		}
+		k = m.i
+	}
+
+	return guesses, warning
+}
+
+func (e *strengthEstimator) findMatches(password []rune) []strengthMatch {
+	var matches []strengthMatch
+	matches = append(matches, bruteforceMatches(password)...)
+	matches = append(matches, dictionaryMatches(password, e.inputs)...)
+	matches = append(matches, sequenceMatches(password)...)
+	matches = append(matches, e.repeatMatches(password)...)
+	matches = append(matches, keyboardMatches(password)...)
+	matches = append(matches, yearMatches(password)...)
+
+	return matches
+}
+
+func bruteforceMatches(password []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := range password {
+		for j := i; j < len(password); j++ {
+			guesses := math.Pow(10, float64(j-i+1))
+			if j == i {
+				guesses++
+			}
+			matches = append(matches, strengthMatch{i: i, j: j, guesses: guesses})
+		}
+	}
+
+	return matches
+}
+
+// dictionaryMatches finds common passwords and user inputs, also spelled
+// backwards or with l33t substitutions.
+func dictionaryMatches(password []rune, inputs map[string]int) []strengthMatch {
+	lower := []rune(strings.ToLower(string(password)))
+	reversed := reverseRunes(lower)
+
+	var matches []strengthMatch
+	for i := range lower {
+		for j := i; j < len(lower); j++ {
+			word := string(lower[i : j+1])
+			upper := uppercaseVariations(password[i : j+1])
+
+			if rank, warning, ok := lookupWord(word, inputs); ok {
+				matches = append(matches, strengthMatch{i: i, j: j, guesses: rank * upper, warning: warning})
+			}
+
+			// Reversed words are matched at the same position.
+			n := len(lower)
+			if rank, warning, ok := lookupWord(string(reversed[n-1-j:n-i]), inputs); ok && j > i {
+				matches = append(matches, strengthMatch{i: i, j: j, guesses: rank * upper * 2, warning: warning})
+			}
+
+			if unleeted, subs := unleet(word); subs > 0 {
+				if rank, warning, ok := lookupWord(unleeted, inputs); ok {
+					matches = append(matches, strengthMatch{i: i, j: j, guesses: rank * upper * math.Pow(2, float64(subs)), warning: warning})
+				}
+			}
+		}
+	}
+
+	return matches
+}
+
+func lookupWord(word string, inputs map[string]int) (float64, string, bool) {
+	if rank, ok := inputs[word]; ok {
+		return float64(rank), "Avoid using your name or email address.", true
+	}
+	if rank, ok := commonPasswords[word]; ok {
+		return float64(rank), "This is a commonly used password.", true
+	}
+
+	return 0, "", false
+}
+
+// uppercaseVariations is how many capitalizations of a word an attacker
+// tries before hitting this one.
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	if upper == 0 {
+		return 1
+	}
+	// Capitalized, all caps and only the last letter upper are tried first.
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+
+	return variations
+}
+
+func unleet(word string) (string, int) {
+	subs := 0
+	out := []rune(word)
+	for i, r := range out {
+		if c, ok := leetSubstitutions[r]; ok {
+			out[i] = c
+			subs++
+		}
+	}
+
+	return string(out), subs
+}
+
+// sequenceMatches finds runs like "abcd", "7531" or "zyx".
+func sequenceMatches(password []rune) []strengthMatch {
+	var matches []strengthMatch
+
+	for i := 0; i < len(password)-1; {
+		delta := password[i+1] - password[i]
+		j := i + 1
+		for j+1 < len(password) && password[j+1]-password[j] == delta {
+			j++
+		}
+
+		if delta != 0 && abs(int(delta)) <= 5 && j-i+1 >= minSequenceLength {
+			start := password[i]
+			base := 26.0
+			switch {
+			case strings.ContainsRune("aAzZ019", start):
+				base = 4
+			case unicode.IsDigit(start):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, strengthMatch{
+				i: i, j: j,
+				guesses: base * float64(j-i+1),
+				warning: "Sequences like abc or 6543 are easy to guess.",
+			})
+		}
+
+		i = j
+	}
+
+	return matches
+}
+
+// repeatMatches finds repeated characters and blocks, like "aaa" or
+// "abcabc". Only the longest repeat starting at a position counts.
+func (e *strengthEstimator) repeatMatches(password []rune) []strengthMatch {
+	var matches []strengthMatch
+	n := len(password)
+
+	for size := 1; size <= n/2; size++ {
+		for i := 0; i+2*size <= n; i++ {
+			block := string(password[i : i+size])
+			// Continuations of the same repeat were covered at its start.
+			if i >= size && string(password[i-size:i]) == block {
+				continue
+			}
+
+			count := 1
+			for i+(count+1)*size <= n && string(password[i+count*size:i+(count+1)*size]) == block {
+				count++
+			}
+
+			if count < 2 || (size == 1 && count < minSequenceLength) {
+				continue
+			}
+
+			base, ok := e.blocks[block]
+			if !ok {
+				base, _ = e.guesses(password[i : i+size])
+				e.blocks[block] = base
+			}
+			matches = append(matches, strengthMatch{
+				i: i, j: i + count*size - 1,
+				guesses: base * float64(count),
+				warning: `Repeats like "aaa" or "abcabc" are easy to guess.`,
+			})
+		}
+	}
+
+	return matches
+}
+
+// keyboardMatches finds straight runs along a row of a QWERTY keyboard.
+func keyboardMatches(password []rune) []strengthMatch {
+	lower := strings.ToLower(string(password))
+	runes := []rune(lower)
+
+	var matches []strengthMatch
+	for i := range runes {
+		for j := i + minKeyboardLength - 1; j < len(runes); j++ {
+			word := string(runes[i : j+1])
+			for _, row := range keyboardRows {
+				guesses := 0.0
+				switch {
+				case strings.Contains(row, word):
+					guesses = float64(len(keyboardRows)) * 10 * float64(j-i+1)
+				case strings.Contains(row, string(reverseRunes([]rune(word)))):
+					guesses = float64(len(keyboardRows)) * 20 * float64(j-i+1)
+				default:
+					continue
+				}
+				matches = append(matches, strengthMatch{
+					i: i, j: j,
+					guesses: guesses * uppercaseVariations(password[i:j+1]),
+					warning: "Straight rows of keys are easy to guess.",
+				})
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// yearMatches finds years from 1900 to 2099.
+func yearMatches(password []rune) []strengthMatch {
+	var matches []strengthMatch
+	current := time.Now().Year()
+
+	for i := 0; i+4 <= len(password); i++ {
+		year := 0
+		for _, r := range password[i : i+4] {
+			if r < '0' || r > '9' {
+				year = -1
+				break
+			}
+			year = year*10 + int(r-'0')
+		}
+
+		if year >= 1900 && year <= 2099 {
+			matches = append(matches, strengthMatch{
+				i: i, j: i + 3,
+				guesses: float64(max(abs(year-current), minYearSpace)),
+				warning: "Years are easy to guess.",
+			})
+		}
+	}
+
+	return matches
+}
+
+func rankedWords(list string) map[string]int {
+	ranks := make(map[string]int)
+	for _, word := range strings.Fields(list) {
+		if _, ok := ranks[word]; !ok {
+			ranks[word] = len(ranks) + 1
+		}
+	}
+
+	return ranks
+}
+
+// rankedInputs ranks user inputs and the parts of email addresses.
+func rankedInputs(inputs []string) map[string]int {
+	var words []string
+	for _, input := range inputs {
+		input = strings.ToLower(input)
+		words = append(words, input)
+		words = append(words, strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+
+	return rankedWords(strings.Join(words, " "))
+}
+
+func reverseRunes(r []rune) []rune {
+	out := make([]rune, len(r))
+	for i, c := range r {
+		out[len(r)-1-i] = c
+	}
+
+	return out
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+
+	return f
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+
+	return r
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
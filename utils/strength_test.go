@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	commonWarning   = "This is a commonly used password."
+	keyboardWarning = "Straight rows of keys are easy to guess."
+	repeatWarning   = `Repeats like "aaa" or "abcabc" are easy to guess.`
+	sequenceWarning = "Sequences like abc or 6543 are easy to guess."
+	yearWarning     = "Years are easy to guess."
+	inputWarning    = "Avoid using your name or email address."
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	const email = "john.smith@example.com"
+
+	tests := []struct {
+		name     string
+		password string
+		inputs   []string
+		score    int
+		warning  string
+	}{
+		{"empty", "", nil, 0, ""},
+		{"common", "password", nil, 0, commonWarning},
+		{"common capitalized", "Password", nil, 0, commonWarning},
+		{"common phrase", "letmein", nil, 0, commonWarning},
+		{"l33t", "P@ssw0rd", nil, 0, commonWarning},
+		{"l33t all substituted", "p4$$w0rd", nil, 0, commonWarning},
+		{"reversed", "drowssap", nil, 0, commonWarning},
+		{"keyboard row", "asdfghjkl;", nil, 0, keyboardWarning},
+		{"keyboard bottom row", "zxcvbnm,./", nil, 0, keyboardWarning},
+		{"repeated character", "aaaaaaaaaa", nil, 0, repeatWarning},
+		{"repeated block", "abcabcabcabc", nil, 0, repeatWarning},
+		{"sequence", "abcdefgh", nil, 0, sequenceWarning},
+		{"year", "1990", nil, 0, yearWarning},
+		{"word and year", "born1990", nil, 1, yearWarning},
+		{"email", email, []string{email}, 0, inputWarning},
+		{"email name parts", "johnsmith", []string{email}, 1, inputWarning},
+		{"email name reversed", "htimsnhoj", []string{email}, 1, inputWarning},
+		{"email parts and symbol", "Smith!Example", []string{email}, 2, inputWarning},
+		{"email name and year", "johnsmith1990", []string{email}, 3, inputWarning},
+		{"short random", "kW8#pZ", nil, 1, ""},
+		{"random", "xK9#mQ2$vL7p", nil, 4, ""},
+		{"l33t word with extras", "Tr0ub4dor&3", nil, 4, ""},
+		{"passphrase", "correct horse battery staple", nil, 4, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EstimatePasswordStrength(tt.password, tt.inputs...)
+			if got.Score != tt.score || got.Warning != tt.warning {
+				t.Errorf("EstimatePasswordStrength(%q) = score %d, warning %q (%.3g guesses), want score %d, warning %q",
+					tt.password, got.Score, got.Warning, got.Guesses, tt.score, tt.warning)
+			}
+		})
+	}
+}
+
+func TestEstimatePasswordStrengthUserInputs(t *testing.T) {
+	for _, password := range []string{"johnsmith", "Smith!Example", "examplejohn"} {
+		without := EstimatePasswordStrength(password)
+		with := EstimatePasswordStrength(password, "john.smith@example.com")
+		if with.Guesses >= without.Guesses {
+			t.Errorf("%q: %.3g guesses with the email as input, want fewer than %.3g without", password, with.Guesses, without.Guesses)
+		}
+	}
+}
+
+func TestEstimatePasswordStrengthLongRepeats(t *testing.T) {
+	// Long input must not blow up the search for repeats.
+	for _, password := range []string{strings.Repeat("a", maxBcryptLength), strings.Repeat("ab1", maxBcryptLength/3)} {
+		start := time.Now()
+		got := EstimatePasswordStrength(password)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%d characters took %v", len(password), elapsed)
+		}
+		if got.Warning != repeatWarning {
+			t.Errorf("got warning %q, want %q", got.Warning, repeatWarning)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpSecretSize = 20
+	totpDigits     = 6
+	totpPeriod     = 30
+	// totpSkew accepts codes from one step before and after the current one
+	// to allow for clock drift on the phone.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10
+	// recoveryAlphabet leaves out characters that are easy to mix up.
+	recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new base32 encoded RFC 6238 secret.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps read from QR codes.
+func TOTPURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// ValidateTOTP checks an authenticator code against the secret and returns
+// the time step it matched. Callers must reject steps at or below the last
+// one used, so a code can't be replayed.
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpCode is the HOTP value of RFC 4226 for the given counter.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateRecoveryCodes returns a fresh set of single-use recovery codes,
+// formatted as "xxxxx-xxxxx".
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	b := make([]byte, recoveryCodeSize)
+
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		// 256 is not a multiple of the alphabet size, so reject the bytes
+		// that would make some characters more likely.
+		code := make([]byte, 0, recoveryCodeSize)
+		for len(code) < recoveryCodeSize {
+			for _, c := range b {
+				if int(c) >= 256-256%len(recoveryAlphabet) {
+					continue
+				}
+				code = append(code, recoveryAlphabet[int(c)%len(recoveryAlphabet)])
+				if len(code) == recoveryCodeSize {
+					break
+				}
+			}
+			if len(code) < recoveryCodeSize {
+				if _, err := rand.Read(b); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		codes[i] = string(code[:5]) + "-" + string(code[5:])
+	}
+
+	return codes, nil
+}
+
+// HashRecoveryCode normalizes a recovery code and hashes it with bcrypt for
+// storage. The codes are short enough to brute force a plain digest.
+func HashRecoveryCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CheckRecoveryCode reports whether code matches a hash from
+// HashRecoveryCode. Codes handed out before are stored as SHA-256 digests
+// and still accepted.
+func CheckRecoveryCode(hash, code string) bool {
+	code = normalizeRecoveryCode(code)
+	if !strings.HasPrefix(hash, "$2") {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(HashToken(code))) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -3,7 +3,9 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/go-playground/validator"
 )
@@ -42,3 +44,43 @@ func WriteJSON(w http.ResponseWriter, status int, payload any) error {
 func WriteError(w http.ResponseWriter, status int, err error) {
 	WriteJSON(w, status, err.Error())
 }
+
+// ClientIP returns the address the request came from. Forwarding headers are
+// ignored since anyone can set them.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// UserAgent returns the request's User-Agent, cut to fit the sessions table.
+func UserAgent(r *http.Request) string {
+	ua := []rune(r.UserAgent())
+	if len(ua) > 255 {
+		ua = ua[:255]
+	}
+
+	return string(ua)
+}
+
+// FormatDuration renders whole hours or minutes for emails, e.g. "24 hours".
+func FormatDuration(d time.Duration) string {
+	unit, name := time.Minute, "minute"
+	if d%time.Hour == 0 {
+		unit, name = time.Hour, "hour"
+	}
+
+	if d%unit != 0 || d <= 0 {
+		return d.String()
+	}
+
+	n := int(d / unit)
+	if n == 1 {
+		return "1 " + name
+	}
+
+	return fmt.Sprintf("%d %ss", n, name)
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers the server accepts, most preferred first.
+const (
+	COSEAlgEdDSA = -8
+	COSEAlgES256 = -7
+	COSEAlgRS256 = -257
+)
+
+var SupportedCOSEAlgorithms = []int{COSEAlgEdDSA, COSEAlgES256, COSEAlgRS256}
+
+// Authenticator data flags.
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttestedData = 0x40
+)
+
+const webauthnChallengeSize = 32
+
+// maxCredentialIDLength is the longest credential ID the WebAuthn spec
+// allows, longer ones must be rejected.
+const maxCredentialIDLength = 1023
+
+// WebAuthnCeremony holds what the server expects from a registration or
+// assertion response.
+type WebAuthnCeremony struct {
+	RPID      string
+	Origins   []string
+	Challenge []byte
+	// UserVerification requires the authenticator to have checked a PIN or
+	// biometric, not just presence.
+	UserVerification bool
+}
+
+// WebAuthnAttestation is the credential created by a registration ceremony.
+type WebAuthnAttestation struct {
+	CredentialID []byte
+	// PublicKey is the COSE encoded credential public key.
+	PublicKey []byte
+	SignCount uint32
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// Only set on registration.
+	credentialID []byte
+	publicKey    []byte
+}
+
+func GenerateWebAuthnChallenge() ([]byte, error) {
+	b := make([]byte, webauthnChallengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// EncodeBase64URL and DecodeBase64URL use the unpadded base64url encoding of
+// the WebAuthn JSON types. Padded input is accepted too.
+func EncodeBase64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// VerifyWebAuthnRegistration checks the response of navigator.credentials.create
+// and returns the new credential. Only "none" attestation is requested, so the
+// attestation statement itself is not verified.
+func VerifyWebAuthnRegistration(c WebAuthnCeremony, clientDataJSON, attestationObject []byte) (*WebAuthnAttestation, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create"); err != nil {
+		return nil, err
+	}
+
+	var attestation struct {
+		Fmt      string          `cbor:"fmt"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+		AuthData []byte          `cbor:"authData"`
+	}
+	if err := cbor.Unmarshal(attestationObject, &attestation); err != nil {
+		return nil, errors.New("invalid attestation object")
+	}
+
+	data, err := c.parseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.flags&authFlagAttestedData == 0 {
+		return nil, errors.New("attestation has no credential data")
+	}
+
+	// Make sure the key is usable before storing it.
+	if _, _, err := parseCOSEKey(data.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnAttestation{
+		CredentialID: data.credentialID,
+		PublicKey:    data.publicKey,
+		SignCount:    data.signCount,
+	}, nil
+}
+
+// VerifyWebAuthnAssertion checks the response of navigator.credentials.get
+// against the stored credential and returns the new signature counter.
+func VerifyWebAuthnAssertion(c WebAuthnCeremony, publicKey []byte, signCount uint32, clientDataJSON, authData, signature []byte) (uint32, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get"); err != nil {
+		return 0, err
+	}
+
+	data, err := c.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clone(authData), clientDataHash[:]...)
+	if err := verifyCOSESignature(publicKey, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators that keep a counter must increase it on every use. A
+	// counter that didn't move means the credential was probably cloned.
+	if (data.signCount != 0 || signCount != 0) && data.signCount <= signCount {
+		return 0, errors.New("signature counter did not increase, the authenticator may be cloned")
+	}
+
+	return data.signCount, nil
+}
+
+func (c WebAuthnCeremony) verifyClientData(raw []byte, ceremonyType string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return errors.New("invalid client data")
+	}
+
+	if data.Type != ceremonyType {
+		return errors.New("wrong ceremony type in client data")
+	}
+
+	challenge, err := DecodeBase64URL(data.Challenge)
+	if err != nil || !bytes.Equal(challenge, c.Challenge) {
+		return errors.New("challenge mismatch")
+	}
+
+	if !slices.Contains(c.Origins, data.Origin) {
+		return errors.New("origin not allowed")
+	}
+
+	return nil
+}
+
+func (c WebAuthnCeremony) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+
+	data := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return nil, errors.New("relying party ID mismatch")
+	}
+
+	if data.flags&authFlagUserPresent == 0 {
+		return nil, errors.New("user presence required")
+	}
+
+	if c.UserVerification && data.flags&authFlagUserVerified == 0 {
+		return nil, errors.New("user verification required")
+	}
+
+	if data.flags&authFlagAttestedData == 0 {
+		return data, nil
+	}
+
+	// Attested credential data: 16 byte AAGUID, 2 byte length, credential ID
+	// and the COSE key.
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || len(rest) < idLen {
+		return nil, errors.New("invalid credential ID")
+	}
+	if idLen > maxCredentialIDLength {
+		return nil, fmt.Errorf("credential ID longer than %d bytes", maxCredentialIDLength)
+	}
+	data.credentialID = rest[:idLen]
+
+	var key cbor.RawMessage
+	if _, err := cbor.UnmarshalFirst(rest[idLen:], &key); err != nil {
+		return nil, errors.New("invalid credential public key")
+	}
+	data.publicKey = key
+
+	return data, nil
+}
+
+// The COSE_Key labels depend on the key type, so the header is decoded first.
+type coseKeyHeader struct {
+	Kty int `cbor:"1,keyasint"`
+	Alg int `cbor:"3,keyasint"`
+}
+
+type coseCurveKey struct {
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint,omitempty"`
+}
+
+type coseRSAKey struct {
+	N []byte `cbor:"-1,keyasint"`
+	E []byte `cbor:"-2,keyasint"`
+}
+
+func parseCOSEKey(raw []byte) (int, crypto.PublicKey, error) {
+	var header coseKeyHeader
+	if err := cbor.Unmarshal(raw, &header); err != nil {
+		return 0, nil, errors.New("invalid credential public key")
+	}
+
+	switch {
+	case header.Alg == COSEAlgEdDSA && header.Kty == 1:
+		var key coseCurveKey
+		if err := cbor.Unmarshal(raw, &key); err != nil || key.Crv != 6 || len(key.X) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("invalid Ed25519 key")
+		}
+		return header.Alg, ed25519.PublicKey(key.X), nil
+
+	case header.Alg == COSEAlgES256 && header.Kty == 2:
+		var key coseCurveKey
+		if err := cbor.Unmarshal(raw, &key); err != nil || key.Crv != 1 || len(key.X) != 32 || len(key.Y) != 32 {
+			return 0, nil, errors.New("invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(key.X),
+			Y:     new(big.Int).SetBytes(key.Y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, errors.New("invalid P-256 key")
+		}
+		return header.Alg, pub, nil
+
+	case header.Alg == COSEAlgRS256 && header.Kty == 3:
+		var key coseRSAKey
+		if err := cbor.Unmarshal(raw, &key); err != nil {
+			return 0, nil, errors.New("invalid RSA key")
+		}
+		n := new(big.Int).SetBytes(key.N)
+		e := new(big.Int).SetBytes(key.E)
+		if n.BitLen() < 2048 || e.BitLen() > 31 || e.Int64() < 3 {
+			return 0, nil, errors.New("invalid RSA key")
+		}
+		return header.Alg, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+
+	return 0, nil, errors.New("unsupported credential algorithm")
+}
+
+func verifyCOSESignature(raw, message, signature []byte) error {
+	_, pub, err := parseCOSEKey(raw)
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	digest := sha256.Sum256(message)
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, message, signature)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	}
+
+	if !ok {
+		return errors.New("invalid assertion signature")
+	}
+
+	return nil
+}
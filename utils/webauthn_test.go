@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// softAuthenticator plays the part of a security key, so ceremonies can be
+// run without a browser.
+type softAuthenticator struct {
+	alg          int
+	key          crypto.Signer
+	credentialID []byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch alg {
+	case COSEAlgEdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case COSEAlgES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case COSEAlgRS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{alg: alg, key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) cosePublicKey(t *testing.T) []byte {
+	t.Helper()
+
+	var key map[int]any
+	switch pub := a.key.Public().(type) {
+	case ed25519.PublicKey:
+		key = map[int]any{1: 1, 3: COSEAlgEdDSA, -1: 6, -2: []byte(pub)}
+	case *ecdsa.PublicKey:
+		key = map[int]any{1: 2, 3: COSEAlgES256, -1: 1, -2: pub.X.FillBytes(make([]byte, 32)), -3: pub.Y.FillBytes(make([]byte, 32))}
+	case *rsa.PublicKey:
+		key = map[int]any{1: 3, 3: COSEAlgRS256, -1: pub.N.Bytes(), -2: big.NewInt(int64(pub.E)).Bytes()}
+	}
+
+	raw, err := cbor.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+// ceremony is what the client and authenticator put into a response. The
+// defaults match testCeremony.
+type ceremony struct {
+	challenge []byte
+	origin    string
+	rpID      string
+	flags     byte
+	signCount uint32
+}
+
+func testCeremony(challenge []byte) (WebAuthnCeremony, ceremony) {
+	return WebAuthnCeremony{RPID: testRPID, Origins: []string{testOrigin}, Challenge: challenge, UserVerification: true},
+		ceremony{challenge: challenge, origin: testOrigin, rpID: testRPID, flags: authFlagUserPresent | authFlagUserVerified}
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremonyType string, c ceremony) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(clientData{Type: ceremonyType, Challenge: EncodeBase64URL(c.challenge), Origin: c.origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func (a *softAuthenticator) authData(c ceremony) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], c.flags)
+	return binary.BigEndian.AppendUint32(data, c.signCount)
+}
+
+// register answers navigator.credentials.create with "none" attestation.
+func (a *softAuthenticator) register(t *testing.T, c ceremony) ([]byte, []byte) {
+	t.Helper()
+
+	c.flags |= authFlagAttestedData
+	authData := a.authData(c)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, a.cosePublicKey(t)...)
+
+	attestationObject, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.clientData(t, "webauthn.create", c), attestationObject
+}
+
+// assert answers navigator.credentials.get.
+func (a *softAuthenticator) assert(t *testing.T, c ceremony) ([]byte, []byte, []byte) {
+	t.Helper()
+
+	clientDataJSON := a.clientData(t, "webauthn.get", c)
+	authData := a.authData(c)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(slices.Clone(authData), clientDataHash[:]...)
+
+	var (
+		signature []byte
+		err       error
+	)
+	if a.alg == COSEAlgEdDSA {
+		signature, err = a.key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = a.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientDataJSON, authData, signature
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		alg  int
+	}{
+		{"ES256", COSEAlgES256},
+		{"EdDSA", COSEAlgEdDSA},
+		{"RS256", COSEAlgRS256},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t, tt.alg)
+
+			challenge, err := GenerateWebAuthnChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, response := testCeremony(challenge)
+
+			clientDataJSON, attestationObject := a.register(t, response)
+			credential, err := VerifyWebAuthnRegistration(expected, clientDataJSON, attestationObject)
+			if err != nil {
+				t.Fatalf("registration: %v", err)
+			}
+			if !slices.Equal(credential.CredentialID, a.credentialID) {
+				t.Errorf("got credential ID %x, want %x", credential.CredentialID, a.credentialID)
+			}
+
+			signCount := credential.SignCount
+			for i := 1; i <= 2; i++ {
+				challenge, err := GenerateWebAuthnChallenge()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, response := testCeremony(challenge)
+				response.signCount = uint32(i)
+
+				clientDataJSON, authData, signature := a.assert(t, response)
+				signCount, err = VerifyWebAuthnAssertion(expected, credential.PublicKey, signCount, clientDataJSON, authData, signature)
+				if err != nil {
+					t.Fatalf("assertion %d: %v", i, err)
+				}
+				if signCount != uint32(i) {
+					t.Errorf("assertion %d: got counter %d, want %d", i, signCount, i)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyWebAuthnRegistrationRejects(t *testing.T) {
+	a := newSoftAuthenticator(t, COSEAlgES256)
+
+	tests := []struct {
+		name    string
+		tamper  func(c *ceremony)
+		wantErr string
+	}{
+		{"wrong challenge", func(c *ceremony) { c.challenge = []byte("another challenge") }, "challenge mismatch"},
+		{"wrong origin", func(c *ceremony) { c.origin = "https://evil.example" }, "origin not allowed"},
+		{"wrong rpId hash", func(c *ceremony) { c.rpID = "evil.example" }, "relying party ID mismatch"},
+		{"user not present", func(c *ceremony) { c.flags &^= authFlagUserPresent }, "user presence required"},
+		{"user not verified", func(c *ceremony) { c.flags &^= authFlagUserVerified }, "user verification required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, response := testCeremony([]byte("registration challenge"))
+			tt.tamper(&response)
+
+			clientDataJSON, attestationObject := a.register(t, response)
+			_, err := VerifyWebAuthnRegistration(expected, clientDataJSON, attestationObject)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWebAuthnRegistrationCredentialIDLength(t *testing.T) {
+	a := newSoftAuthenticator(t, COSEAlgES256)
+
+	for _, n := range []int{maxCredentialIDLength, maxCredentialIDLength + 1} {
+		a.credentialID = make([]byte, n)
+
+		expected, response := testCeremony([]byte("registration challenge"))
+		clientDataJSON, attestationObject := a.register(t, response)
+		_, err := VerifyWebAuthnRegistration(expected, clientDataJSON, attestationObject)
+
+		if n <= maxCredentialIDLength && err != nil {
+			t.Errorf("%d byte credential ID: unexpected error: %v", n, err)
+		}
+		if n > maxCredentialIDLength && (err == nil || !strings.Contains(err.Error(), "credential ID longer than")) {
+			t.Errorf("%d byte credential ID: got error %v, want it rejected", n, err)
+		}
+	}
+}
+
+func TestVerifyWebAuthnAssertionRejects(t *testing.T) {
+	a := newSoftAuthenticator(t, COSEAlgES256)
+	other := newSoftAuthenticator(t, COSEAlgES256)
+	const storedCount = 5
+
+	tests := []struct {
+		name    string
+		tamper  func(c *ceremony)
+		signer  *softAuthenticator
+		wantErr string
+	}{
+		{"wrong challenge", func(c *ceremony) { c.challenge = []byte("another challenge") }, a, "challenge mismatch"},
+		{"wrong origin", func(c *ceremony) { c.origin = "https://evil.example" }, a, "origin not allowed"},
+		{"wrong rpId hash", func(c *ceremony) { c.rpID = "evil.example" }, a, "relying party ID mismatch"},
+		{"user not present", func(c *ceremony) { c.flags &^= authFlagUserPresent }, a, "user presence required"},
+		{"user not verified", func(c *ceremony) { c.flags &^= authFlagUserVerified }, a, "user verification required"},
+		{"signed by another key", func(c *ceremony) {}, other, "invalid assertion signature"},
+		{"counter unchanged", func(c *ceremony) { c.signCount = storedCount }, a, "signature counter did not increase"},
+		{"counter went back", func(c *ceremony) { c.signCount = storedCount - 1 }, a, "signature counter did not increase"},
+		{"counter reset", func(c *ceremony) { c.signCount = 0 }, a, "signature counter did not increase"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, response := testCeremony([]byte("assertion challenge"))
+			response.signCount = storedCount + 1
+			tt.tamper(&response)
+
+			clientDataJSON, authData, signature := tt.signer.assert(t, response)
+			_, err := VerifyWebAuthnAssertion(expected, a.cosePublicKey(t), storedCount, clientDataJSON, authData, signature)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("tampered signature", func(t *testing.T) {
+		expected, response := testCeremony([]byte("assertion challenge"))
+		response.signCount = storedCount + 1
+
+		clientDataJSON, authData, signature := a.assert(t, response)
+		signature[len(signature)-1] ^= 0xff
+		_, err := VerifyWebAuthnAssertion(expected, a.cosePublicKey(t), storedCount, clientDataJSON, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "invalid assertion signature") {
+			t.Fatalf("got error %v, want an invalid signature", err)
+		}
+	})
+}
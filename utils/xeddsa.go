@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519/field"
+)
+
+const (
+	curve25519KeySize = 32
+	// djbKeyType prefixes serialized Curve25519 public keys in libsignal.
+	djbKeyType    = 0x05
+	signatureSize = 64
+)
+
+// VerifySignedPrekey decodes an uploaded key bundle and checks that the signed
+// prekey was signed by the identity key, the way libsignal clients do it:
+// XEdDSA over the serialized signed prekey.
+func VerifySignedPrekey(identityKey, signedPrekey, signature string) error {
+	_, identity, err := decodePublicKey("identity_key", identityKey)
+	if err != nil {
+		return err
+	}
+
+	// The signature covers the signed prekey exactly as serialized by the
+	// client, so keep the type prefix when there is one.
+	prekey, _, err := decodePublicKey("signed_prekey", signedPrekey)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("signed_prekey_signature is not valid base64")
+	}
+	if len(sig) != signatureSize {
+		return fmt.Errorf("signed_prekey_signature must be %d bytes, got %d", signatureSize, len(sig))
+	}
+
+	if !xeddsaVerify(identity, prekey, sig) {
+		return errors.New("signed_prekey_signature does not match identity_key")
+	}
+
+	return nil
+}
+
+// decodePublicKey returns the key as serialized by the client and the raw 32
+// byte Curve25519 key, accepting both the bare key and the 33 byte libsignal
+// serialization.
+func decodePublicKey(name, encoded string) (serialized, key []byte, err error) {
+	serialized, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s is not valid base64", name)
+	}
+
+	switch {
+	case len(serialized) == curve25519KeySize:
+		return serialized, serialized, nil
+	case len(serialized) == curve25519KeySize+1 && serialized[0] == djbKeyType:
+		return serialized, serialized[1:], nil
+	default:
+		return nil, nil, fmt.Errorf("%s must be a %d byte Curve25519 key, got %d bytes", name, curve25519KeySize, len(serialized))
+	}
+}
+
+// xeddsaVerify checks an XEdDSA signature made with a Curve25519 key. The
+// Montgomery key is mapped to its Edwards form, taking the sign bit the signer
+// stored in the top bit of the signature, and then checked as plain Ed25519.
+func xeddsaVerify(publicKey, message, signature []byte) bool {
+	u, err := new(field.Element).SetBytes(publicKey)
+	if err != nil {
+		return false
+	}
+
+	// y = (u - 1) / (u + 1), undefined for u = -1.
+	one := new(field.Element).One()
+	denominator := new(field.Element).Add(u, one)
+	if denominator.Equal(new(field.Element).Zero()) == 1 {
+		return false
+	}
+	numerator := new(field.Element).Subtract(u, one)
+	y := new(field.Element).Multiply(numerator, new(field.Element).Invert(denominator))
+
+	edPublicKey := y.Bytes()
+	edPublicKey[31] |= signature[63] & 0x80
+
+	sig := make([]byte, signatureSize)
+	copy(sig, signature)
+	sig[63] &= 0x7f
+
+	return ed25519.Verify(edPublicKey, message, sig)
+}